@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redacted = "[REDACTED]"
+
+type AccessLogConfig struct {
+	// Format is "json", the default, "common" or "combined".
+	Format string `json:"format"`
+	// Output is "stdout", the default, or a file path.
+	Output string `json:"output"`
+
+	// MaxSizeMB is the size at which the file is rotated, defaults to 100. MaxBackups
+	// and MaxAgeDays bound the rotated files kept, 0 keeps all.
+	MaxSizeMB  int  `json:"max_size_mb"`
+	MaxBackups int  `json:"max_backups"`
+	MaxAgeDays int  `json:"max_age_days"`
+	Compress   bool `json:"compress"`
+
+	// Redact lists entry fields like "client_ip" whose value is replaced, and query
+	// parameters as "query:<name>".
+	Redact []string `json:"redact"`
+}
+
+// AccessLogEntry is written for every proxied request.
+type AccessLogEntry struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id,omitempty"`
+	ClientIP   string    `json:"client_ip"`
+	Consumer   string    `json:"consumer,omitempty"`
+	Method     string    `json:"method"`
+	URI        string    `json:"uri"`
+	Protocol   string    `json:"protocol"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	Route      string    `json:"route,omitempty"`
+	Upstream   string    `json:"upstream,omitempty"`
+	Retries    int       `json:"retries"`
+	DurationMs float64   `json:"duration_ms"`
+	FilterMs   float64   `json:"filter_ms"`
+	UpstreamMs float64   `json:"upstream_ms"`
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+}
+
+type AccessLogger struct {
+	format string
+	redact map[string]bool
+	// query parameters to redact
+	redactQuery map[string]bool
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func NewAccessLogger(cfg *AccessLogConfig) (*AccessLogger, error) {
+	l := &AccessLogger{
+		format:      cfg.Format,
+		redact:      make(map[string]bool),
+		redactQuery: make(map[string]bool),
+	}
+
+	switch l.format {
+	case "":
+		l.format = "json"
+	case "json", "common", "combined":
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", cfg.Format)
+	}
+
+	for _, field := range cfg.Redact {
+		if strings.HasPrefix(field, "query:") {
+			l.redactQuery[strings.TrimPrefix(field, "query:")] = true
+		} else {
+			l.redact[field] = true
+		}
+	}
+
+	if cfg.Output == "" || cfg.Output == "stdout" {
+		l.out = os.Stdout
+	} else {
+		maxSize := cfg.MaxSizeMB
+		if maxSize <= 0 {
+			maxSize = 100
+		}
+		l.out = &lumberjack.Logger{
+			Filename:   cfg.Output,
+			MaxSize:    maxSize,
+			MaxBackups: cfg.MaxBackups,
+			MaxAge:     cfg.MaxAgeDays,
+			Compress:   cfg.Compress,
+		}
+	}
+
+	return l, nil
+}
+
+// Log writes the entry, redacted, in the configured format.
+func (l *AccessLogger) Log(e *AccessLogEntry) error {
+	l.redactEntry(e)
+
+	var line []byte
+	if l.format == "json" {
+		var err error
+		if line, err = json.Marshal(e); err != nil {
+			return err
+		}
+	} else {
+		line = []byte(l.formatCLF(e))
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.out.Write(line)
+	return err
+}
+
+func (l *AccessLogger) redactEntry(e *AccessLogEntry) {
+	if len(l.redactQuery) > 0 {
+		e.URI = redactQuery(e.URI, l.redactQuery)
+	}
+
+	fields := map[string]*string{
+		"request_id": &e.RequestID,
+		"client_ip":  &e.ClientIP,
+		"consumer":   &e.Consumer,
+		"uri":        &e.URI,
+		"route":      &e.Route,
+		"upstream":   &e.Upstream,
+		"referer":    &e.Referer,
+		"user_agent": &e.UserAgent,
+	}
+	for name, v := range fields {
+		if l.redact[name] && *v != "" {
+			*v = redacted
+		}
+	}
+}
+
+func redactQuery(uri string, names map[string]bool) string {
+	i := strings.IndexByte(uri, '?')
+	if i < 0 {
+		return uri
+	}
+
+	query, err := url.ParseQuery(uri[i+1:])
+	if err != nil {
+		return uri[:i+1] + redacted
+	}
+	for name := range names {
+		if _, ok := query[name]; ok {
+			query[name] = []string{redacted}
+		}
+	}
+	return uri[:i+1] + query.Encode()
+}
+
+// formatCLF formats like `127.0.0.1 - alice [10/Oct/2000:13:55:36 -0700] "GET / HTTP/1.1" 200 2326`,
+// combined appends the referer and user agent.
+func (l *AccessLogger) formatCLF(e *AccessLogEntry) string {
+	s := fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %d`,
+		clfValue(e.ClientIP), clfValue(e.Consumer), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, e.URI, e.Protocol, e.Status, e.Bytes)
+	if l.format == "combined" {
+		s += fmt.Sprintf(` "%s" "%s"`, clfValue(e.Referer), clfValue(e.UserAgent))
+	}
+	return s
+}
+
+func clfValue(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return strings.Replace(v, `"`, `\"`, -1)
+}
+
+// sampled tells whether the route's sampling rate picks the request. Server errors
+// are always logged.
+func sampled(route *RouteSpec, status int) bool {
+	if route == nil || route.AccessLogSampleRate == nil || status >= 500 {
+		return true
+	}
+	return rand.Float64() < *route.AccessLogSampleRate
+}
+
+// accessLogHandler logs the requests once they are answered. It needs the request
+// context, so it goes inside withRequestContext.
+type accessLogHandler struct {
+	next   http.Handler
+	logger *AccessLogger
+}
+
+func NewAccessLogHandler(next http.Handler, logger *AccessLogger) http.Handler {
+	return &accessLogHandler{
+		next:   next,
+		logger: logger,
+	}
+}
+
+func (h *accessLogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	rw := &statusRecorder{ResponseWriter: w}
+
+	h.next.ServeHTTP(rw, r)
+
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+
+	rc := getRequestContext(r)
+	if !sampled(rc.route, rw.status) {
+		return
+	}
+
+	e := &AccessLogEntry{
+		Time:       start,
+		RequestID:  rc.requestID,
+		Method:     rc.method,
+		URI:        r.URL.RequestURI(),
+		Protocol:   r.Proto,
+		Status:     rw.status,
+		Bytes:      rw.bytes,
+		Retries:    rc.retries,
+		DurationMs: milliseconds(time.Since(start)),
+		FilterMs:   milliseconds(rc.filterDuration),
+		UpstreamMs: milliseconds(rc.upstreamDuration),
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+	}
+	if rc.clientIP != nil {
+		e.ClientIP = rc.clientIP.String()
+	}
+	if rc.identity != nil {
+		e.Consumer = rc.identity.Subject
+	}
+	if rc.route != nil {
+		e.Route = rc.route.ID()
+	}
+	if rc.upstream != nil {
+		e.Upstream = rc.upstream.Host
+	}
+
+	if err := h.logger.Log(e); err != nil {
+		fmt.Println("access log:", err)
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// statusRecorder records the status and the body size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogFormats(t *testing.T) {
+	e := AccessLogEntry{
+		Time:      time.Date(2000, 10, 10, 13, 55, 36, 0, time.UTC),
+		ClientIP:  "10.0.0.1",
+		Method:    "GET",
+		URI:       "/svc1/items?token=secret&page=2",
+		Protocol:  "HTTP/1.1",
+		Status:    200,
+		Bytes:     2326,
+		UserAgent: "curl/7.0",
+	}
+
+	cases := []struct {
+		format string
+		expect string
+	}{
+		{"common", `10.0.0.1 - - [10/Oct/2000:13:55:36 +0000] "GET /svc1/items?page=2&token=%5BREDACTED%5D HTTP/1.1" 200 2326`},
+		{"combined", `[REDACTED] - - [10/Oct/2000:13:55:36 +0000] "GET /svc1/items?page=2&token=%5BREDACTED%5D HTTP/1.1" 200 2326 "-" "curl/7.0"`},
+	}
+
+	for _, c := range cases {
+		redact := []string{"query:token"}
+		if c.format == "combined" {
+			redact = append(redact, "client_ip")
+		}
+		l, err := NewAccessLogger(&AccessLogConfig{Format: c.format, Redact: redact})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		l.out = &buf
+
+		entry := e
+		if err := l.Log(&entry); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(buf.String()); got != c.expect {
+			t.Errorf("%s:\n got %s\nwant %s", c.format, got, c.expect)
+		}
+	}
+}
+
+func TestAccessLogHandler(t *testing.T) {
+	l, err := NewAccessLogger(&AccessLogConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	l.out = &buf
+
+	never := 0.0
+	route := &RouteSpec{Name: "sampled-out", AccessLogSampleRate: &never}
+
+	h := withRequestContext(NewRequestIDHandler(NewAccessLogHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sampled-out" {
+			getRequestContext(r).route = route
+		}
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	}), l)))
+
+	for _, path := range []string{"/logged", "/sampled-out"} {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("X-Request-Id", "abc")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected one line, got %q", buf.String())
+	}
+
+	var e AccessLogEntry
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Status != http.StatusTeapot || e.Bytes != 15 || e.URI != "/logged" || e.RequestID != "abc" || e.ClientIP != "192.0.2.1" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+)
+
+type AdminConfig struct {
+	// Addr is where the admin endpoints listen, like "127.0.0.1:8085". Empty
+	// disables them.
+	Addr string `json:"addr"`
+	// Token, when set, must be sent as "Authorization: Bearer <token>".
+	Token string `json:"token"`
+	// Persist writes the changes made through the admin api back to the config file,
+	// otherwise they are lost on the next reload or restart.
+	Persist bool `json:"persist"`
+}
+
+// withAdminAuth checks the admin token, if there is one.
+func withAdminAuth(next http.Handler, token string) http.Handler {
+	if token == "" {
+		return next
+	}
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mini-gateway admin"`)
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminMux serves the admin endpoints, features register theirs in init.
+var adminMux = http.NewServeMux()
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+var startTime = time.Now()
+
+// loadedConfig and gatewayServer are what the admin endpoints report on, set in main.
+// The admin API replaces loadedConfig with configMu held.
+var (
+	loadedConfig     *Config
+	loadedConfigPath string
+	gatewayServer    *Server
+	configMu         sync.RWMutex
+)
+
+func init() {
+	adminMux.HandleFunc("/debug/pprof/", pprof.Index)
+	adminMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	adminMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	adminMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	adminMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	adminMux.HandleFunc("/version", handleVersion)
+	adminMux.HandleFunc("/config", handleConfig)
+	adminMux.HandleFunc("/routes", handleRoutes)
+	adminMux.HandleFunc("/upstreams", handleUpstreams)
+	adminMux.HandleFunc("/ratelimits", handleRateLimits)
+	adminMux.HandleFunc("/reload", handleReload)
+	adminMux.HandleFunc("/drain", handleDrain)
+	adminMux.HandleFunc("/ready", handleReady)
+}
+
+// allowMethods answers 405 unless the request uses one of methods.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	return false
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"version":    version,
+		"go_version": runtime.Version(),
+		"pid":        os.Getpid(),
+		"started_at": startTime,
+	})
+}
+
+// secretConfigKeys are the config fields whose values /config does not show.
+var secretConfigKeys = map[string]bool{
+	"password": true,
+	"token":    true,
+	"headers":  true, // otlp headers carry api keys
+}
+
+func redactSecrets(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if secretConfigKeys[k] && child != nil && child != "" {
+				v[k] = redacted
+				continue
+			}
+			redactSecrets(child)
+		}
+	case []interface{}:
+		for _, child := range v {
+			redactSecrets(child)
+		}
+	}
+}
+
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	configMu.RLock()
+	data, err := json.Marshal(loadedConfig)
+	configMu.RUnlock()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	var cfg interface{}
+	json.Unmarshal(data, &cfg)
+	redactSecrets(cfg)
+
+	writeJSON(w, http.StatusOK, cfg)
+}
+
+type filterInfo struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Order int    `json:"order"`
+}
+
+type routeInfo struct {
+	ID      string       `json:"id"`
+	Filters []filterInfo `json:"filters"`
+	Error   string       `json:"error,omitempty"`
+	Spec    *RouteSpec   `json:"spec"`
+	// Bindings are the routes transcoded upstreams generate, one per HTTP rule of
+	// their annotated methods. Upstreams without static descriptors are reflected.
+	Bindings []string `json:"bindings,omitempty"`
+}
+
+// compiledRoutes returns the routes in match order with their filters in run order,
+// PRE before POST.
+func compiledRoutes() []routeInfo {
+	routes := loadRoutes().routes
+	infos := make([]routeInfo, 0, len(routes))
+	for _, route := range routes {
+		info := routeInfo{ID: route.ID(), Spec: route, Filters: []filterInfo{}}
+
+		for _, name := range route.Filters {
+			f, ok := registeredFilters[name]
+			if !ok {
+				info.Error = "unknown filter " + name
+				continue
+			}
+			info.Filters = append(info.Filters, filterInfo{Name: name, Type: f.GetType(), Order: f.GetOrder()})
+		}
+		seen := make(map[string]bool)
+		for i := range route.Upstreams {
+			tc, err := upstreamTranscoder(&route.Upstreams[i])
+			if err != nil && info.Error == "" {
+				info.Error = err.Error()
+			}
+			if tc == nil {
+				continue
+			}
+			for _, b := range tc.bindings {
+				if s := b.String(); !seen[s] {
+					seen[s] = true
+					info.Bindings = append(info.Bindings, s)
+				}
+			}
+		}
+
+		sort.SliceStable(info.Filters, func(i, j int) bool {
+			a, b := info.Filters[i], info.Filters[j]
+			if a.Type != b.Type {
+				return a.Type == "PRE"
+			}
+			return a.Order < b.Order
+		})
+
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// upstreamTranscoder returns the transcoder of a transcoded upstream, reflected by
+// the gateway's transport if it has no static descriptors.
+func upstreamTranscoder(u *Upstream) (*transcoder, error) {
+	if !u.Transcode || u.transcoder != nil {
+		return u.transcoder, nil
+	}
+	if gatewayServer == nil {
+		return nil, nil
+	}
+	g, ok := gatewayServer.grpcTransport.(*defaultGrpcTransport)
+	if !ok {
+		return nil, nil
+	}
+	tc, err := g.transcoder(u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %s: %v", u.Host, err)
+	}
+	return tc, nil
+}
+
+// handleRoutes lists the routes on GET and adds one on POST, see handleCreateRoute.
+func handleRoutes(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+	if r.Method == http.MethodPost {
+		handleCreateRoute(w, r)
+		return
+	}
+
+	configMu.RLock()
+	defer configMu.RUnlock()
+	writeVersioned(w, http.StatusOK, compiledRoutes())
+}
+
+type upstreamInfo struct {
+	Host        string              `json:"host"`
+	Schema      string              `json:"schema"`
+	Routes      []string            `json:"routes"`
+	Health      UpstreamHealthState `json:"health"`
+	Concurrency *ConcurrencyState   `json:"concurrency,omitempty"`
+}
+
+func handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	var limits map[string]ConcurrencyState
+	if gatewayServer != nil && gatewayServer.concurrency != nil {
+		_, limits = gatewayServer.concurrency.states()
+	}
+
+	byHost := make(map[string]*upstreamInfo)
+	var hosts []string
+	for _, route := range loadRoutes().routes {
+		for _, u := range route.Upstreams {
+			info, ok := byHost[u.Host]
+			if !ok {
+				info = &upstreamInfo{Host: u.Host, Schema: u.Schema, Health: UpstreamHealthState{Healthy: true}}
+				if gatewayServer != nil && gatewayServer.health != nil {
+					info.Health = gatewayServer.health.State(u.Host)
+				}
+				if state, ok := limits[u.Host]; ok {
+					info.Concurrency = &state
+				}
+				byHost[u.Host] = info
+				hosts = append(hosts, u.Host)
+			}
+			info.Routes = append(info.Routes, route.ID())
+		}
+	}
+
+	infos := make([]*upstreamInfo, 0, len(hosts))
+	for _, host := range hosts {
+		infos = append(infos, byHost[host])
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+type rateLimitRuleInfo struct {
+	Scope string         `json:"scope"`
+	Rule  *RateLimitRule `json:"rule"`
+	// ActiveKeys is the number of limiters kept for the rule, only known for the local
+	// store.
+	ActiveKeys *int `json:"active_keys,omitempty"`
+}
+
+func rateLimitRuleInfos(lim *RateLimiter) []rateLimitRuleInfo {
+	infos := make([]rateLimitRuleInfo, 0, len(lim.rules))
+	for _, rule := range lim.rules {
+		info := rateLimitRuleInfo{Scope: lim.scope, Rule: rule}
+		if local, ok := lim.store.(*localRateLimitStore); ok {
+			n := local.activeKeys(rule)
+			info.ActiveKeys = &n
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+func handleRateLimits(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	rules := []rateLimitRuleInfo{}
+	store := "local"
+	var routeConcurrency map[string]ConcurrencyState
+	if s := gatewayServer; s != nil {
+		if s.globalLimiter != nil {
+			rules = append(rules, rateLimitRuleInfos(s.globalLimiter)...)
+			if _, ok := s.globalLimiter.store.(*redisRateLimitStore); ok {
+				store = "redis"
+			}
+		}
+		if s.routeLimiters != nil {
+			for _, route := range loadRoutes().routes {
+				if len(route.RateLimits) > 0 {
+					rules = append(rules, rateLimitRuleInfos(s.routeLimiters.peek(route))...)
+				}
+			}
+		}
+		if s.concurrency != nil {
+			routeConcurrency, _ = s.concurrency.states()
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"store":             store,
+		"rules":             rules,
+		"route_concurrency": routeConcurrency,
+	})
+}
+
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	if gatewayServer == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "server not running"})
+		return
+	}
+	if err := gatewayServer.reload(); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "reloading"})
+}
+
+// handleDrain starts draining on POST and stops it on DELETE, see Server.SetDraining.
+func handleDrain(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	if gatewayServer == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "server not running"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		gatewayServer.SetDraining(true)
+	case http.MethodDelete:
+		gatewayServer.SetDraining(false)
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"draining": gatewayServer.Draining()})
+}
+
+// handleReady is the readiness check for load balancers, it fails while draining.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	if gatewayServer == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "starting"})
+		return
+	}
+	if gatewayServer.Draining() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "draining"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
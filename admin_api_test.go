@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func adminRequest(t *testing.T, h http.Handler, method, path, token string) (int, string) {
+	r := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec.Code, rec.Body.String()
+}
+
+func TestAdminAPI(t *testing.T) {
+	defer func(cfg *Config, s *Server, t *routeTable) {
+		loadedConfig, gatewayServer = cfg, s
+		currentRoutes.Store(t)
+	}(loadedConfig, gatewayServer, loadRoutes())
+
+	routes := []RouteSpec{{
+		Name:      "svc",
+		Path:      "^/svc/(.*)",
+		Upstreams: []Upstream{{Host: "localhost:9000", Schema: "http"}},
+		Filters:   []string{"rbac", "cors"},
+	}}
+	setRoutes(routes)
+	loadedConfig = &Config{
+		Admin:     AdminConfig{Token: "s3cret"},
+		RateLimit: &RateLimitConfig{Redis: &RedisRateLimitConfig{Addr: "redis:6379", Password: "hunter2"}},
+		Routes:    routes,
+	}
+	gatewayServer = &Server{health: newUpstreamHealth(), concurrency: newConcurrencyLimiters(loadRoutes())}
+	h := withAdminAuth(adminMux, loadedConfig.Admin.Token)
+
+	if code, _ := adminRequest(t, h, "GET", "/routes", ""); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", code)
+	}
+
+	code, body := adminRequest(t, h, "GET", "/config", "s3cret")
+	if code != http.StatusOK || strings.Contains(body, "hunter2") || strings.Contains(body, "s3cret") {
+		t.Errorf("expected the config without secrets, got %d %s", code, body)
+	}
+
+	_, body = adminRequest(t, h, "GET", "/routes", "s3cret")
+	var infos []routeInfo
+	if err := json.Unmarshal([]byte(body), &infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || len(infos[0].Filters) != 2 || infos[0].Filters[0].Name != "cors" {
+		t.Errorf("expected cors to run before rbac, got %s", body)
+	}
+
+	if code, _ := adminRequest(t, h, "GET", "/ready", "s3cret"); code != http.StatusOK {
+		t.Errorf("expected ready, got %d", code)
+	}
+	if code, _ := adminRequest(t, h, "POST", "/drain", "s3cret"); code != http.StatusOK {
+		t.Errorf("expected drain to succeed, got %d", code)
+	}
+	if code, _ := adminRequest(t, h, "GET", "/ready", "s3cret"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected not ready while draining, got %d", code)
+	}
+	if code, _ := adminRequest(t, h, "GET", "/reload", "s3cret"); code != http.StatusMethodNotAllowed {
+		t.Errorf("expected GET /reload to be rejected, got %d", code)
+	}
+}
+
+func TestAdminRateLimitsReadOnly(t *testing.T) {
+	defer func(s *Server, t *routeTable) {
+		gatewayServer = s
+		currentRoutes.Store(t)
+	}(gatewayServer, loadRoutes())
+
+	setRoutes([]RouteSpec{{
+		Name:       "limited",
+		Path:       "^/limited/(.*)",
+		Upstreams:  []Upstream{{Host: "localhost:9000", Schema: "http"}},
+		RateLimits: []RateLimitRule{{Name: "per-ip", Descriptors: []RateLimitDescriptor{{Key: "client_ip"}}, Rate: 1, Burst: 1}},
+	}})
+	store := newLocalRateLimitStore(10)
+	gatewayServer = &Server{routeLimiters: newRouteRateLimiters(store, false)}
+
+	code, body := adminRequest(t, adminMux, "GET", "/ratelimits", "")
+	if code != http.StatusOK || !strings.Contains(body, `"scope": "route:limited"`) {
+		t.Fatalf("expected the route's rules, got %d %s", code, body)
+	}
+	if len(gatewayServer.routeLimiters.lims) != 0 || len(store.rules) != 0 {
+		t.Errorf("expected reading the rate limits to create no limiters, got %d routes and %d rules",
+			len(gatewayServer.routeLimiters.lims), len(store.rules))
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	adminMux.HandleFunc("/routes/", handleRoute)
+	adminMux.HandleFunc("/consumers", handleConsumers)
+	adminMux.HandleFunc("/consumers/", handleConsumer)
+}
+
+// configETag is the ETag of the routes and consumers, a hash of their json so that
+// it stays the same across restarts and instances serving the same config. Called
+// with configMu held.
+func configETag() string {
+	data, _ := json.Marshal(struct {
+		Routes    []RouteSpec
+		Consumers []Consumer
+	}{loadedConfig.Routes, loadedConfig.Consumers})
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// checkIfMatch requires the ETag the client based its change on, so that two
+// clients do not overwrite each other's changes. Called with configMu held.
+func checkIfMatch(w http.ResponseWriter, r *http.Request) bool {
+	match := r.Header.Get("If-Match")
+	switch {
+	case match == "":
+		writeJSON(w, http.StatusPreconditionRequired, map[string]string{"error": "If-Match header required"})
+		return false
+	case match != "*" && match != configETag():
+		w.Header().Set("ETag", configETag())
+		writeJSON(w, http.StatusPreconditionFailed, map[string]string{"error": "config changed, current version is " + configETag()})
+		return false
+	}
+	return true
+}
+
+// writeVersioned writes v with the current ETag. Called with configMu held.
+func writeVersioned(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("ETag", configETag())
+	writeJSON(w, status, v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func decodeJSON(r *http.Request, v interface{}) error {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	// the same decoding as LoadConfig
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("invalid json: %v", err)
+	}
+	return nil
+}
+
+// applyChange validates the config with routes and consumers, persists it if the
+// admin config asks so, and makes it live. Called with configMu held.
+func applyChange(routes []*RouteSpec, consumers []Consumer) (int, error) {
+	cfg := *loadedConfig
+	cfg.Routes = make([]RouteSpec, len(routes))
+	for i, route := range routes {
+		cfg.Routes[i] = *route
+	}
+	cfg.Consumers = consumers
+
+	if err := cfg.Validate(); err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+	table, err := newRouteTable(routes)
+	if err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+
+	if cfg.Admin.Persist && loadedConfigPath != "" {
+		if err := writeConfigFile(loadedConfigPath, &cfg); err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("can not persist config: %v", err)
+		}
+	}
+
+	currentRoutes.Store(table)
+	if quotaManager != nil {
+		quotaManager.SetConsumers(consumers)
+	}
+	if s := gatewayServer; s != nil {
+		if s.routeLimiters != nil {
+			s.routeLimiters.prune(table)
+		}
+		if s.concurrency != nil {
+			s.concurrency.prune(table)
+		}
+		s.refreshGrpcDescriptors()
+	}
+
+	loadedConfig = &cfg
+	return http.StatusOK, nil
+}
+
+// writeConfigFile replaces the config file, keeping its mode.
+func writeConfigFile(path string, cfg *Config) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode()
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// handleCreateRoute serves POST /routes, the route is added last.
+func handleCreateRoute(w http.ResponseWriter, r *http.Request) {
+	var route RouteSpec
+	if err := decodeJSON(r, &route); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if route.Name == "" {
+		writeError(w, http.StatusUnprocessableEntity, fmt.Errorf("routes managed through the admin api need a name"))
+		return
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+	if !checkIfMatch(w, r) {
+		return
+	}
+
+	current := loadRoutes().routes
+	if loadRoutes().find(route.Name) != nil {
+		writeError(w, http.StatusConflict, fmt.Errorf("route %s exists", route.Name))
+		return
+	}
+
+	routes := append(append([]*RouteSpec{}, current...), &route)
+	if status, err := applyChange(routes, loadedConfig.Consumers); err != nil {
+		writeError(w, status, err)
+		return
+	}
+	w.Header().Set("Location", "/routes/"+route.Name)
+	writeVersioned(w, http.StatusCreated, &route)
+}
+
+// handleRoute serves /routes/<name> and /routes/<name>/upstreams[/<host>]. Routes
+// are addressed by name, routes without one can only be listed.
+func handleRoute(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/routes/"), "/", 3)
+	name := parts[0]
+	if name == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(parts) > 1 {
+		if parts[1] != "upstreams" {
+			http.NotFound(w, r)
+			return
+		}
+		host := ""
+		if len(parts) == 3 {
+			host = parts[2]
+		}
+		handleRouteUpstreams(w, r, name, host)
+		return
+	}
+
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut, http.MethodDelete) {
+		return
+	}
+
+	var route RouteSpec
+	if r.Method == http.MethodPut {
+		if err := decodeJSON(r, &route); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if route.Name == "" {
+			route.Name = name
+		}
+		if route.Name != name {
+			writeError(w, http.StatusUnprocessableEntity, fmt.Errorf("route name %s does not match the url", route.Name))
+			return
+		}
+	}
+
+	if r.Method == http.MethodGet {
+		configMu.RLock()
+		defer configMu.RUnlock()
+	} else {
+		configMu.Lock()
+		defer configMu.Unlock()
+	}
+
+	current := loadRoutes().routes
+	index := -1
+	for i, rt := range current {
+		if rt.Name == name {
+			index = i
+		}
+	}
+	if index < 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no route %s", name))
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		writeVersioned(w, http.StatusOK, current[index])
+		return
+	}
+	if !checkIfMatch(w, r) {
+		return
+	}
+
+	routes := append([]*RouteSpec{}, current...)
+	if r.Method == http.MethodPut {
+		routes[index] = &route
+	} else {
+		routes = append(routes[:index], routes[index+1:]...)
+	}
+
+	if status, err := applyChange(routes, loadedConfig.Consumers); err != nil {
+		writeError(w, status, err)
+		return
+	}
+	if r.Method == http.MethodPut {
+		writeVersioned(w, http.StatusOK, &route)
+	} else {
+		w.Header().Set("ETag", configETag())
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleRouteUpstreams lists the upstreams of a route on GET, replaces them on PUT,
+// adds one on POST and removes the one of host on DELETE.
+func handleRouteUpstreams(w http.ResponseWriter, r *http.Request, name, host string) {
+	if host == "" && !allowMethods(w, r, http.MethodGet, http.MethodPut, http.MethodPost) {
+		return
+	}
+	if host != "" && !allowMethods(w, r, http.MethodDelete) {
+		return
+	}
+
+	var upstreams []Upstream
+	switch r.Method {
+	case http.MethodPut:
+		if err := decodeJSON(r, &upstreams); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	case http.MethodPost:
+		var u Upstream
+		if err := decodeJSON(r, &u); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		upstreams = []Upstream{u}
+	}
+
+	if r.Method == http.MethodGet {
+		configMu.RLock()
+		defer configMu.RUnlock()
+	} else {
+		configMu.Lock()
+		defer configMu.Unlock()
+	}
+
+	current := loadRoutes().routes
+	index := -1
+	for i, rt := range current {
+		if rt.Name == name {
+			index = i
+		}
+	}
+	if index < 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no route %s", name))
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		writeVersioned(w, http.StatusOK, current[index].Upstreams)
+		return
+	}
+	if !checkIfMatch(w, r) {
+		return
+	}
+
+	route := *current[index]
+	switch r.Method {
+	case http.MethodPut:
+		route.Upstreams = upstreams
+	case http.MethodPost:
+		route.Upstreams = append(append([]Upstream{}, route.Upstreams...), upstreams...)
+	case http.MethodDelete:
+		route.Upstreams = nil
+		for _, u := range current[index].Upstreams {
+			if u.Host != host {
+				route.Upstreams = append(route.Upstreams, u)
+			}
+		}
+		if len(route.Upstreams) == len(current[index].Upstreams) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("route %s has no upstream %s", name, host))
+			return
+		}
+	}
+
+	routes := append([]*RouteSpec{}, current...)
+	routes[index] = &route
+	if status, err := applyChange(routes, loadedConfig.Consumers); err != nil {
+		writeError(w, status, err)
+		return
+	}
+	writeVersioned(w, http.StatusOK, route.Upstreams)
+}
+
+// handleConsumers lists the consumers on GET and adds one on POST.
+func handleConsumers(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		configMu.RLock()
+		defer configMu.RUnlock()
+		consumers := loadedConfig.Consumers
+		if consumers == nil {
+			consumers = []Consumer{}
+		}
+		writeVersioned(w, http.StatusOK, consumers)
+		return
+	}
+
+	var consumer Consumer
+	if err := decodeJSON(r, &consumer); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+	if !checkIfMatch(w, r) {
+		return
+	}
+	for _, c := range loadedConfig.Consumers {
+		if c.Name == consumer.Name {
+			writeError(w, http.StatusConflict, fmt.Errorf("consumer %s exists", consumer.Name))
+			return
+		}
+	}
+
+	consumers := append(append([]Consumer{}, loadedConfig.Consumers...), consumer)
+	if status, err := applyChange(loadRoutes().routes, consumers); err != nil {
+		writeError(w, status, err)
+		return
+	}
+	w.Header().Set("Location", "/consumers/"+consumer.Name)
+	writeVersioned(w, http.StatusCreated, consumer)
+}
+
+// handleConsumer serves GET, PUT and DELETE /consumers/<name>.
+func handleConsumer(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/consumers/")
+	if name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut, http.MethodDelete) {
+		return
+	}
+
+	var consumer Consumer
+	if r.Method == http.MethodPut {
+		if err := decodeJSON(r, &consumer); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if consumer.Name == "" {
+			consumer.Name = name
+		}
+		if consumer.Name != name {
+			writeError(w, http.StatusUnprocessableEntity, fmt.Errorf("consumer name %s does not match the url", consumer.Name))
+			return
+		}
+	}
+
+	if r.Method == http.MethodGet {
+		configMu.RLock()
+		defer configMu.RUnlock()
+	} else {
+		configMu.Lock()
+		defer configMu.Unlock()
+	}
+
+	index := -1
+	for i, c := range loadedConfig.Consumers {
+		if c.Name == name {
+			index = i
+		}
+	}
+
+	if r.Method == http.MethodGet {
+		if index < 0 {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no consumer %s", name))
+			return
+		}
+		writeVersioned(w, http.StatusOK, loadedConfig.Consumers[index])
+		return
+	}
+	if !checkIfMatch(w, r) {
+		return
+	}
+
+	consumers := append([]Consumer{}, loadedConfig.Consumers...)
+	status := http.StatusOK
+	switch {
+	case r.Method == http.MethodDelete && index < 0:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no consumer %s", name))
+		return
+	case r.Method == http.MethodDelete:
+		consumers = append(consumers[:index], consumers[index+1:]...)
+	case index < 0:
+		consumers = append(consumers, consumer)
+		status = http.StatusCreated
+	default:
+		consumers[index] = consumer
+	}
+
+	if code, err := applyChange(loadRoutes().routes, consumers); err != nil {
+		writeError(w, code, err)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		w.Header().Set("ETag", configETag())
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeVersioned(w, status, consumer)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func adminChange(h http.Handler, method, path, etag, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if etag != "" {
+		r.Header.Set("If-Match", etag)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestAdminRouteCRUD(t *testing.T) {
+	defer func(cfg *Config, path string, t *routeTable) {
+		loadedConfig, loadedConfigPath = cfg, path
+		currentRoutes.Store(t)
+	}(loadedConfig, loadedConfigPath, loadRoutes())
+
+	dir, err := ioutil.TempDir("", "admin-routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	routes := []RouteSpec{{
+		Name:      "svc",
+		Path:      "^/svc/(.*)",
+		Upstreams: []Upstream{{Host: "localhost:9000", Schema: "http"}},
+	}}
+	setRoutes(routes)
+	loadedConfig = &Config{Admin: AdminConfig{Persist: true}, Routes: routes}
+	loadedConfigPath = filepath.Join(dir, "config.json")
+
+	svc, _ := matchRoute("/svc/x")
+
+	rec := adminChange(adminMux, "GET", "/routes", "", "")
+	etag := rec.Header().Get("ETag")
+	initial := etag
+
+	newRoute := `{"name": "orders", "path": "^/orders/(.*)", "upstreams": [{"host": "localhost:9001", "schema": "http"}]}`
+	if rec := adminChange(adminMux, "POST", "/routes", "", newRoute); rec.Code != http.StatusPreconditionRequired {
+		t.Errorf("expected If-Match to be required, got %d", rec.Code)
+	}
+	if rec := adminChange(adminMux, "POST", "/routes", etag, `{"name": "bad", "path": "^/bad/(.*)", "upstreams": []}`); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected a route without upstreams to be rejected, got %d %s", rec.Code, rec.Body)
+	}
+
+	rec = adminChange(adminMux, "POST", "/routes", etag, newRoute)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected the route to be created, got %d %s", rec.Code, rec.Body)
+	}
+	if route, _ := matchRoute("/orders/1"); route == nil || route.Name != "orders" {
+		t.Errorf("expected the new route to be live, got %v", route)
+	}
+	if route, _ := matchRoute("/svc/x"); route != svc {
+		t.Errorf("expected the unchanged route to keep its pointer")
+	}
+
+	// the old etag is stale now
+	if rec := adminChange(adminMux, "DELETE", "/routes/orders", etag, ""); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected a stale If-Match to fail, got %d", rec.Code)
+	}
+	etag = rec.Header().Get("ETag")
+
+	rec = adminChange(adminMux, "POST", "/routes/orders/upstreams", etag, `{"host": "localhost:9002", "schema": "http"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the upstream to be added, got %d %s", rec.Code, rec.Body)
+	}
+	etag = rec.Header().Get("ETag")
+
+	cfg, err := LoadConfig(loadedConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Routes) != 2 || len(cfg.Routes[1].Upstreams) != 2 {
+		data, _ := json.Marshal(cfg.Routes)
+		t.Errorf("expected the change to be persisted, got %s", data)
+	}
+
+	rec = adminChange(adminMux, "DELETE", "/routes/orders", etag, "")
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("expected the route to be deleted, got %d %s", rec.Code, rec.Body)
+	}
+	// the etag is a hash of the config, the initial one fits it again
+	if got := rec.Header().Get("ETag"); got != initial {
+		t.Errorf("expected the initial etag %s, got %s", initial, got)
+	}
+	if route, _ := matchRoute("/orders/1"); route != nil {
+		t.Errorf("expected the route to be gone")
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pires/go-proxyproto"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type ClientIPConfig struct {
+	// TrustedProxies are the IPs and CIDRs of the proxies in front of the gateway.
+	// Only they may tell the client address through X-Forwarded-For, Forwarded or
+	// the PROXY protocol.
+	TrustedProxies []string `json:"trusted_proxies"`
+	// ForwardedHeader is the header the trusted proxies append the client address
+	// to, "X-Forwarded-For" by default or "Forwarded". The other one is ignored, a
+	// proxy passes it on from the client unchanged.
+	ForwardedHeader string `json:"forwarded_header"`
+	// ProxyProtocol accepts PROXY protocol v1 and v2 headers on the listener.
+	ProxyProtocol bool `json:"proxy_protocol"`
+}
+
+// ClientIPResolver finds the address of the client behind the trusted proxies.
+type ClientIPResolver struct {
+	trusted []*net.IPNet
+	// forwarded tells to read Forwarded rather than X-Forwarded-For.
+	forwarded bool
+}
+
+var clientIPResolver = &ClientIPResolver{}
+
+func NewClientIPResolver(trustedProxies []string, forwardedHeader string) (*ClientIPResolver, error) {
+	trusted, err := parseCIDRs(trustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxy: %v", err)
+	}
+	c := &ClientIPResolver{trusted: trusted}
+	switch http.CanonicalHeaderKey(forwardedHeader) {
+	case "", "X-Forwarded-For":
+	case "Forwarded":
+		c.forwarded = true
+	default:
+		return nil, fmt.Errorf("forwarded_header must be X-Forwarded-For or Forwarded, not %q", forwardedHeader)
+	}
+	return c, nil
+}
+
+// parseCIDRs parses CIDRs and bare IPs, which become single address networks.
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an ip", s)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ClientIPResolver) isTrusted(ip net.IP) bool {
+	return containsIP(c.trusted, ip)
+}
+
+// Resolve returns the client address. The forwarding header of the trusted proxies is
+// read right to left and only as long as the hop which appended the entry is trusted.
+func (c *ClientIPResolver) Resolve(r *http.Request) net.IP {
+	peer := parseHostIP(r.RemoteAddr)
+	if peer == nil || !c.isTrusted(peer) {
+		return peer
+	}
+
+	var hops []string
+	if c.forwarded {
+		hops = forwardedFor(r.Header.Values("Forwarded"))
+	} else {
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(v, ",")...)
+		}
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHostIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			// "unknown", an obfuscated identifier or garbage. the trusted hop which
+			// added it is as far as we can tell.
+			break
+		}
+		client = ip
+		if !c.isTrusted(ip) {
+			break
+		}
+	}
+
+	return client
+}
+
+// forwardedFor returns the for= values of RFC 7239 Forwarded headers.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, v := range values {
+		for _, element := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					hops = append(hops, strings.Trim(kv[1], `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// parseHostIP parses "ip", "ip:port", "[ipv6]" and "[ipv6]:port", nil if it is none
+// of them.
+func parseHostIP(s string) net.IP {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	if i := strings.IndexByte(s, '%'); i >= 0 {
+		s = s[:i]
+	}
+	return net.ParseIP(s)
+}
+
+// ProxyProtocolListener reads PROXY protocol headers from trusted proxies, headers
+// from anybody else are dropped.
+func (c *ClientIPResolver) ProxyProtocolListener(l net.Listener) net.Listener {
+	return &proxyproto.Listener{
+		Listener: l,
+		Policy: func(upstream net.Addr) (proxyproto.Policy, error) {
+			if ip := parseHostIP(upstream.String()); ip != nil && c.isTrusted(ip) {
+				return proxyproto.USE, nil
+			}
+			return proxyproto.IGNORE, nil
+		},
+	}
+}
+
+// RequestClientIP returns the client address resolved when the request arrived.
+func RequestClientIP(r *http.Request) net.IP {
+	if ip := getRequestContext(r).clientIP; ip != nil {
+		return ip
+	}
+	return clientIPResolver.Resolve(r)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientIPResolve(t *testing.T) {
+	trusted := []string{"10.0.0.0/8", "fd00::/8", "192.0.2.1"}
+	resolver, err := NewClientIPResolver(trusted, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwarded, err := NewClientIPResolver(trusted, "forwarded")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		resolver   *ClientIPResolver
+		remoteAddr string
+		header     http.Header
+		want       string
+	}{
+		{resolver, "203.0.113.7:1234", nil, "203.0.113.7"},
+		{resolver, "[2001:db8::1]:443", nil, "2001:db8::1"},
+		{resolver, "[fe80::1%eth0]:443", nil, "fe80::1"},
+		// untrusted peers can not spoof
+		{resolver, "203.0.113.7:1234", http.Header{"X-Forwarded-For": {"1.2.3.4"}}, "203.0.113.7"},
+		{resolver, "10.1.1.1:1234", http.Header{"X-Forwarded-For": {"1.2.3.4, 198.51.100.9, 10.2.2.2"}}, "198.51.100.9"},
+		{resolver, "10.1.1.1:1234", http.Header{"X-Forwarded-For": {"1.2.3.4", "10.2.2.2"}}, "1.2.3.4"},
+		{resolver, "[fd00::1]:1234", http.Header{"X-Forwarded-For": {"2001:db8::2"}}, "2001:db8::2"},
+		{resolver, "10.1.1.1:1234", http.Header{"X-Forwarded-For": {"unknown"}}, "10.1.1.1"},
+		// a client's own Forwarded passes an X-Forwarded-For proxy unchanged
+		{resolver, "10.1.1.1:1234", http.Header{
+			"Forwarded":       {"for=1.2.3.4"},
+			"X-Forwarded-For": {"198.51.100.9"},
+		}, "198.51.100.9"},
+		{forwarded, "192.0.2.1:1234", http.Header{
+			"Forwarded":       {`for=198.51.100.17;proto=https, for="[2001:db8:cafe::17]:4711"`},
+			"X-Forwarded-For": {"1.2.3.4"},
+		}, "2001:db8:cafe::17"},
+		{forwarded, "192.0.2.1:1234", http.Header{"Forwarded": {`for="_hidden", for=10.3.3.3`}}, "10.3.3.3"},
+		{forwarded, "192.0.2.1:1234", http.Header{"X-Forwarded-For": {"1.2.3.4"}}, "192.0.2.1"},
+	}
+
+	for _, c := range cases {
+		r := &http.Request{RemoteAddr: c.remoteAddr, Header: c.header}
+		if r.Header == nil {
+			r.Header = http.Header{}
+		}
+		if got := c.resolver.Resolve(r); got.String() != c.want {
+			t.Errorf("%s %v: got %v, want %s", c.remoteAddr, c.header, got, c.want)
+		}
+	}
+}
+
+func TestClientIPForwardedHeader(t *testing.T) {
+	if _, err := NewClientIPResolver(nil, "X-Real-Ip"); err == nil {
+		t.Error("expected an unknown forwarded header to fail")
+	}
+}
+
+func TestIPAccessPolicy(t *testing.T) {
+	p := &IPAccessPolicy{Allow: []string{"10.0.0.0/8", "2001:db8::/32"}, Deny: []string{"10.0.0.1"}}
+
+	for ip, want := range map[string]bool{
+		"10.1.2.3":    true,
+		"10.0.0.1":    false,
+		"192.0.2.1":   false,
+		"2001:db8::5": true,
+		"2001:db9::5": false,
+	} {
+		if got := p.Allows(parseHostIP(ip)); got != want {
+			t.Errorf("%s: got %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestIPAccessPolicyValidate(t *testing.T) {
+	if err := (&IPAccessPolicy{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.1"}}).Validate(); err != nil {
+		t.Error(err)
+	}
+
+	cfg := defaultConfig()
+	cfg.Routes = []RouteSpec{{
+		Path:      "^/app/(.*)",
+		Upstreams: []Upstream{{Host: "127.0.0.1:8080", Schema: "http"}},
+		IPAccess:  &IPAccessPolicy{Allow: []string{"10.0.0.0/33"}},
+	}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected the config to reject an invalid cidr")
+	}
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var errConcurrencyLimited = errors.New("too many concurrent requests")
+
+type ConcurrencyConfig struct {
+	// MaxConcurrency is the limit of requests in flight. With Adaptive it is the
+	// upper bound of the adaptive limit.
+	MaxConcurrency int `json:"max_concurrency"`
+	// MaxQueue bounds the requests waiting for a slot, 0 rejects right away. When the
+	// queue is full a request pushes out a waiting request of lower priority.
+	MaxQueue int `json:"max_queue"`
+	// QueueTimeout is how long a request waits at most, defaults to 1s.
+	QueueTimeout Duration `json:"queue_timeout"`
+
+	Adaptive *AdaptiveConcurrencyConfig `json:"adaptive"`
+}
+
+// AdaptiveConcurrencyConfig adjusts the limit to the observed latency, in the manner
+// of Netflix concurrency-limits.
+type AdaptiveConcurrencyConfig struct {
+	// Algorithm is "aimd", the default, or "gradient".
+	Algorithm    string `json:"algorithm"`
+	MinLimit     int    `json:"min_limit"`
+	InitialLimit int    `json:"initial_limit"`
+
+	// aimd: a request slower than Timeout, or failing, multiplies the limit by
+	// BackoffRatio, defaults 1s and 0.9.
+	Timeout      Duration `json:"timeout"`
+	BackoffRatio float64  `json:"backoff_ratio"`
+
+	// gradient: the limit shrinks when the latency rises above Tolerance times the
+	// long term average latency, defaults to 2.
+	Tolerance float64 `json:"tolerance"`
+}
+
+// PriorityClass gives a priority to matching requests, the first matching class wins
+// and requests matching none have priority 0. Lower priorities are shed first.
+type PriorityClass struct {
+	Name     string `json:"name"`
+	Priority int    `json:"priority"`
+
+	// Paths are globs as in RBACRule, Consumers identity subjects. A class without
+	// any of them matches nothing.
+	Paths     []string `json:"paths"`
+	Consumers []string `json:"consumers"`
+	Roles     []string `json:"roles"`
+}
+
+var registeredPriorityClasses []PriorityClass
+
+func (c *PriorityClass) matches(r *http.Request) bool {
+	_, p := RequestMethodAndPath(r)
+	for _, pattern := range c.Paths {
+		if pathMatch(pattern, p) {
+			return true
+		}
+	}
+
+	id := RequestIdentity(r)
+	if id == nil {
+		return false
+	}
+	if containsString(c.Consumers, id.Subject) {
+		return true
+	}
+	for _, role := range c.Roles {
+		if id.HasRole(role) {
+			return true
+		}
+	}
+	return false
+}
+
+func requestPriority(r *http.Request) int {
+	for i := range registeredPriorityClasses {
+		if registeredPriorityClasses[i].matches(r) {
+			return registeredPriorityClasses[i].Priority
+		}
+	}
+	return 0
+}
+
+// ConcurrencyLimiter limits the requests in flight and queues the ones over the limit
+// by priority.
+type ConcurrencyLimiter struct {
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	queue    []*concurrencyWaiter
+	seq      uint64
+
+	maxQueue     int
+	queueTimeout time.Duration
+	adaptive     adaptiveLimit
+}
+
+type concurrencyWaiter struct {
+	priority int
+	seq      uint64
+	// ready gets true when the waiter got a slot, false when it was pushed out.
+	ready chan bool
+}
+
+// adaptiveLimit computes the new limit after a request finished. It is called with the
+// limiter locked.
+type adaptiveLimit interface {
+	update(limit float64, rtt time.Duration, inFlight int, dropped bool) float64
+}
+
+func NewConcurrencyLimiter(cfg *ConcurrencyConfig) *ConcurrencyLimiter {
+	l := &ConcurrencyLimiter{
+		limit:        float64(cfg.MaxConcurrency),
+		maxQueue:     cfg.MaxQueue,
+		queueTimeout: time.Duration(cfg.QueueTimeout),
+	}
+	if l.queueTimeout <= 0 {
+		l.queueTimeout = time.Second
+	}
+
+	if a := cfg.Adaptive; a != nil {
+		min, max := float64(a.MinLimit), float64(cfg.MaxConcurrency)
+		if min < 1 {
+			min = 1
+		}
+		if a.InitialLimit > 0 {
+			l.limit = float64(a.InitialLimit)
+		}
+
+		if a.Algorithm == "gradient" {
+			tolerance := a.Tolerance
+			if tolerance <= 0 {
+				tolerance = 2
+			}
+			l.adaptive = &gradientLimit{min: min, max: max, tolerance: tolerance}
+		} else {
+			timeout, backoff := time.Duration(a.Timeout), a.BackoffRatio
+			if timeout <= 0 {
+				timeout = time.Second
+			}
+			if backoff <= 0 || backoff >= 1 {
+				backoff = 0.9
+			}
+			l.adaptive = &aimdLimit{min: min, max: max, timeout: timeout, backoff: backoff}
+		}
+	}
+
+	return l
+}
+
+// Limit returns the current limit.
+func (l *ConcurrencyLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// ConcurrencyState is a snapshot of a ConcurrencyLimiter.
+type ConcurrencyState struct {
+	Limit    int `json:"limit"`
+	InFlight int `json:"in_flight"`
+	Queued   int `json:"queued"`
+}
+
+func (l *ConcurrencyLimiter) State() ConcurrencyState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return ConcurrencyState{Limit: int(l.limit), InFlight: l.inFlight, Queued: len(l.queue)}
+}
+
+// Acquire waits for a slot. The returned func must be called once the request is
+// done, telling whether it failed in a way that hints at overload.
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context, priority int) (func(dropped bool), error) {
+	l.mu.Lock()
+
+	if l.inFlight < int(l.limit) && len(l.queue) == 0 {
+		l.inFlight++
+		l.mu.Unlock()
+		return l.releaser(), nil
+	}
+
+	if len(l.queue) >= l.maxQueue {
+		lowest := l.lowest()
+		if lowest < 0 || l.queue[lowest].priority >= priority {
+			l.mu.Unlock()
+			return nil, errConcurrencyLimited
+		}
+		l.queue[lowest].ready <- false
+		l.remove(lowest)
+	}
+
+	l.seq++
+	w := &concurrencyWaiter{priority: priority, seq: l.seq, ready: make(chan bool, 1)}
+	l.queue = append(l.queue, w)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case ok := <-w.ready:
+		if ok {
+			return l.releaser(), nil
+		}
+		return nil, errConcurrencyLimited
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, queued := range l.queue {
+		if queued == w {
+			l.remove(i)
+			return nil, errConcurrencyLimited
+		}
+	}
+
+	// granted or pushed out while we gave up
+	if <-w.ready {
+		l.inFlight--
+		l.grant()
+	}
+	return nil, errConcurrencyLimited
+}
+
+func (l *ConcurrencyLimiter) releaser() func(dropped bool) {
+	start := time.Now()
+	var once sync.Once
+	return func(dropped bool) {
+		once.Do(func() {
+			l.release(time.Since(start), dropped)
+		})
+	}
+}
+
+func (l *ConcurrencyLimiter) release(rtt time.Duration, dropped bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.adaptive != nil {
+		l.limit = l.adaptive.update(l.limit, rtt, l.inFlight, dropped)
+	}
+	l.inFlight--
+	l.grant()
+}
+
+// grant hands free slots to the waiters, highest priority first.
+func (l *ConcurrencyLimiter) grant() {
+	for l.inFlight < int(l.limit) && len(l.queue) > 0 {
+		highest := 0
+		for i, w := range l.queue {
+			top := l.queue[highest]
+			if w.priority > top.priority || (w.priority == top.priority && w.seq < top.seq) {
+				highest = i
+			}
+		}
+		l.inFlight++
+		l.queue[highest].ready <- true
+		l.remove(highest)
+	}
+}
+
+// lowest returns the index of the waiter to shed first, the newest of the lowest
+// priority.
+func (l *ConcurrencyLimiter) lowest() int {
+	lowest := -1
+	for i, w := range l.queue {
+		if lowest < 0 {
+			lowest = i
+			continue
+		}
+		low := l.queue[lowest]
+		if w.priority < low.priority || (w.priority == low.priority && w.seq > low.seq) {
+			lowest = i
+		}
+	}
+	return lowest
+}
+
+func (l *ConcurrencyLimiter) remove(i int) {
+	l.queue = append(l.queue[:i], l.queue[i+1:]...)
+}
+
+// aimdLimit grows the limit by one while requests are fast and the limit is used,
+// and shrinks it multiplicatively on slow or failed requests.
+type aimdLimit struct {
+	min, max float64
+	timeout  time.Duration
+	backoff  float64
+}
+
+func (a *aimdLimit) update(limit float64, rtt time.Duration, inFlight int, dropped bool) float64 {
+	if dropped || rtt > a.timeout {
+		limit = limit * a.backoff
+	} else if float64(inFlight)*2 >= limit {
+		limit++
+	}
+	return math.Max(a.min, math.Min(a.max, limit))
+}
+
+// gradientLimit compares the latency of a request to the long term average latency
+// and shrinks the limit by that ratio, with some headroom of sqrt(limit) to probe for
+// more capacity.
+type gradientLimit struct {
+	min, max  float64
+	tolerance float64
+	longRTT   float64 // exponential moving average, in seconds
+}
+
+func (g *gradientLimit) update(limit float64, rtt time.Duration, inFlight int, dropped bool) float64 {
+	sample := rtt.Seconds()
+	if g.longRTT == 0 {
+		g.longRTT = sample
+	} else {
+		g.longRTT = g.longRTT*0.99 + sample*0.01
+	}
+
+	// do not grow a limit which is not used
+	if !dropped && float64(inFlight)*2 < limit {
+		return limit
+	}
+
+	gradient := 1.0
+	if sample > 0 {
+		gradient = math.Max(0.5, math.Min(1, g.tolerance*g.longRTT/sample))
+	}
+	if dropped {
+		gradient = 0.5
+	}
+
+	newLimit := limit*gradient + math.Sqrt(limit)
+	// smooth the change
+	newLimit = limit*0.8 + newLimit*0.2
+	return math.Max(g.min, math.Min(g.max, newLimit))
+}
+
+// concurrencyLimiters holds the limiters of the routes and upstreams.
+type concurrencyLimiters struct {
+	mu        sync.Mutex
+	routes    map[*RouteSpec]*ConcurrencyLimiter
+	upstreams map[string]*ConcurrencyLimiter // by host
+	configs   map[string]*ConcurrencyConfig  // of the upstream limiters
+}
+
+// newConcurrencyLimiters creates the upstream limiters of the routes in t, the route
+// limiters are created on first use.
+func newConcurrencyLimiters(t *routeTable) *concurrencyLimiters {
+	c := &concurrencyLimiters{routes: make(map[*RouteSpec]*ConcurrencyLimiter)}
+	c.setUpstreams(t)
+	return c
+}
+
+// setUpstreams creates a limiter for every host with a concurrency config in t,
+// keeping the ones whose config did not change. Validate makes sure the routes
+// agree on the config of a host. Called with c.mu held or before c is used.
+func (c *concurrencyLimiters) setUpstreams(t *routeTable) {
+	upstreams := make(map[string]*ConcurrencyLimiter)
+	configs := make(map[string]*ConcurrencyConfig)
+	for _, route := range t.routes {
+		for _, u := range route.Upstreams {
+			if u.Concurrency == nil || configs[u.Host] != nil {
+				continue
+			}
+			configs[u.Host] = u.Concurrency
+			if l, ok := c.upstreams[u.Host]; ok && reflect.DeepEqual(c.configs[u.Host], u.Concurrency) {
+				upstreams[u.Host] = l
+			} else {
+				upstreams[u.Host] = NewConcurrencyLimiter(u.Concurrency)
+			}
+		}
+	}
+	c.upstreams, c.configs = upstreams, configs
+}
+
+func (c *concurrencyLimiters) forRoute(route *RouteSpec) *ConcurrencyLimiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l, ok := c.routes[route]
+	if !ok {
+		l = NewConcurrencyLimiter(route.Concurrency)
+		c.routes[route] = l
+	}
+	return l
+}
+
+// forUpstream returns the limiter of the upstream's host, nil if it has none.
+func (c *concurrencyLimiters) forUpstream(upstream *Upstream) *ConcurrencyLimiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.upstreams[upstream.Host]
+}
+
+// prune drops the limiters of the routes not in t and sets the upstream limiters to
+// the ones of t. Upstream limiters are shared by host, an unchanged one is kept.
+func (c *concurrencyLimiters) prune(t *routeTable) {
+	live := make(map[*RouteSpec]bool, len(t.routes))
+	for _, route := range t.routes {
+		live[route] = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for route := range c.routes {
+		if !live[route] {
+			delete(c.routes, route)
+		}
+	}
+	c.setUpstreams(t)
+}
+
+// states returns the state of the limiters created so far, by route and by upstream
+// host.
+func (c *concurrencyLimiters) states() (map[string]ConcurrencyState, map[string]ConcurrencyState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	routes := make(map[string]ConcurrencyState, len(c.routes))
+	for route, l := range c.routes {
+		routes[route.ID()] = l.State()
+	}
+	upstreams := make(map[string]ConcurrencyState, len(c.upstreams))
+	for host, l := range c.upstreams {
+		upstreams[host] = l.State()
+	}
+	return routes, upstreams
+}
+
+// Acquire takes a slot of the request's route and of its upstream, if they have a
+// limit. The returned func releases them.
+func (c *concurrencyLimiters) Acquire(r *http.Request) (func(dropped bool), error) {
+	rc := getRequestContext(r)
+	priority := requestPriority(r)
+
+	var releases []func(bool)
+	release := func(dropped bool) {
+		for _, rel := range releases {
+			rel(dropped)
+		}
+	}
+
+	if rc.route != nil && rc.route.Concurrency != nil {
+		rel, err := c.forRoute(rc.route).Acquire(r.Context(), priority)
+		if err != nil {
+			return nil, err
+		}
+		releases = append(releases, rel)
+	}
+
+	if rc.upstream != nil {
+		if l := c.forUpstream(rc.upstream); l != nil {
+			rel, err := l.Acquire(r.Context(), priority)
+			if err != nil {
+				release(false)
+				return nil, err
+			}
+			releases = append(releases, rel)
+		}
+	}
+
+	return release, nil
+}
+
+// releaseOnClose calls release once the body has been read or closed.
+type releaseOnClose struct {
+	io.ReadCloser
+	release func(dropped bool)
+}
+
+func (b *releaseOnClose) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.release(false)
+	}
+	return n, err
+}
+
+func (b *releaseOnClose) Close() error {
+	b.release(false)
+	return b.ReadCloser.Close()
+}
+
+// isStreamedResponse tells whether resp is an upgrade or an event stream, whose
+// duration says nothing about the latency of the upstream.
+func isStreamedResponse(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return true
+	}
+	mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mt == sseContentType || mt == ndjsonContentType
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiterQueue(t *testing.T) {
+	l := NewConcurrencyLimiter(&ConcurrencyConfig{MaxConcurrency: 1, MaxQueue: 1, QueueTimeout: Duration(time.Second)})
+
+	release, err := l.Acquire(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	low := make(chan error, 1)
+	go func() {
+		rel, err := l.Acquire(context.Background(), 0)
+		if err == nil {
+			rel(false)
+		}
+		low <- err
+	}()
+	waitQueued(t, l, 1)
+
+	// the queue is full, a request of the same priority is rejected right away
+	if _, err := l.Acquire(context.Background(), 0); err != errConcurrencyLimited {
+		t.Fatalf("expected rejection, got %v", err)
+	}
+
+	// a higher priority pushes out the low one
+	high := make(chan error, 1)
+	go func() {
+		rel, err := l.Acquire(context.Background(), 10)
+		if err == nil {
+			rel(false)
+		}
+		high <- err
+	}()
+	if err := <-low; err != errConcurrencyLimited {
+		t.Fatalf("expected the low priority request to be shed, got %v", err)
+	}
+
+	release(false)
+	if err := <-high; err != nil {
+		t.Fatalf("expected the high priority request to get the slot, got %v", err)
+	}
+}
+
+func TestConcurrencyLimiterQueueTimeout(t *testing.T) {
+	l := NewConcurrencyLimiter(&ConcurrencyConfig{MaxConcurrency: 1, MaxQueue: 1, QueueTimeout: Duration(10 * time.Millisecond)})
+
+	release, _ := l.Acquire(context.Background(), 0)
+	if _, err := l.Acquire(context.Background(), 0); err != errConcurrencyLimited {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	release(false)
+
+	if _, err := l.Acquire(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAIMDLimit(t *testing.T) {
+	l := NewConcurrencyLimiter(&ConcurrencyConfig{
+		MaxConcurrency: 20,
+		Adaptive:       &AdaptiveConcurrencyConfig{InitialLimit: 10, MinLimit: 2},
+	})
+
+	var releases []func(bool)
+	for i := 0; i < 10; i++ {
+		rel, err := l.Acquire(context.Background(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		releases = append(releases, rel)
+	}
+	releases[0](false)
+	if l.Limit() != 11 {
+		t.Fatalf("expected the limit to grow to 11, got %d", l.Limit())
+	}
+
+	for _, rel := range releases[1:] {
+		rel(true)
+	}
+	if l.Limit() >= 10 {
+		t.Fatalf("expected the limit to shrink, got %d", l.Limit())
+	}
+}
+
+func waitQueued(t *testing.T, l *ConcurrencyLimiter, n int) {
+	for i := 0; i < 100; i++ {
+		l.mu.Lock()
+		queued := len(l.queue)
+		l.mu.Unlock()
+		if queued == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d queued requests", n)
+}
+
+func TestUpstreamConcurrencyLimiters(t *testing.T) {
+	shared := func(max int) []Upstream {
+		return []Upstream{{Host: "orders:8080", Schema: "http", Concurrency: &ConcurrencyConfig{MaxConcurrency: max}}}
+	}
+	routes := []RouteSpec{
+		{Name: "a", Path: "^/a/(.*)", Upstreams: shared(2)},
+		{Name: "b", Path: "^/b/(.*)", Upstreams: shared(2)},
+		{Name: "c", Path: "^/c/(.*)", Upstreams: []Upstream{{Host: "orders:8080", Schema: "http"}}},
+	}
+	cfg := &Config{Routes: routes}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Routes = append(cfg.Routes, RouteSpec{Name: "d", Path: "^/d/(.*)", Upstreams: shared(5)})
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected routes disagreeing on the limit of a host to be rejected")
+	}
+
+	table := func(routes []RouteSpec) *routeTable {
+		specs := make([]*RouteSpec, len(routes))
+		for i := range routes {
+			specs[i] = &routes[i]
+		}
+		return &routeTable{routes: specs}
+	}
+	c := newConcurrencyLimiters(table(routes))
+	l := c.forUpstream(&routes[2].Upstreams[0])
+	if l == nil || l != c.forUpstream(&routes[0].Upstreams[0]) || l.State().Limit != 2 {
+		t.Fatalf("expected one limiter of 2 for the host, got %+v", l)
+	}
+
+	c.prune(table(routes[:2]))
+	if c.forUpstream(&routes[0].Upstreams[0]) != l {
+		t.Error("expected an unchanged limiter to be kept")
+	}
+	c.prune(table([]RouteSpec{{Name: "a", Path: "^/a/(.*)", Upstreams: shared(5)}}))
+	if l := c.forUpstream(&routes[0].Upstreams[0]); l == nil || l.State().Limit != 5 {
+		t.Errorf("expected a new limiter for the changed limit, got %+v", l)
+	}
+	c.prune(table(routes[2:]))
+	if l := c.forUpstream(&routes[0].Upstreams[0]); l != nil {
+		t.Errorf("expected no limiter once no route configures the host, got %+v", l)
+	}
+}
+
+func TestConcurrencyReleasesStreams(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: 1\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+
+	defer currentRoutes.Store(loadRoutes())
+	setRoutes([]RouteSpec{{
+		Name:      "events",
+		Path:      "^/events(.*)",
+		Upstreams: []Upstream{{Host: strings.TrimPrefix(upstream.URL, "http://"), Schema: "http"}},
+		Concurrency: &ConcurrencyConfig{MaxConcurrency: 10, Adaptive: &AdaptiveConcurrencyConfig{
+			InitialLimit: 5, Timeout: Duration(50 * time.Millisecond),
+		}},
+	}})
+
+	limiters := newConcurrencyLimiters(loadRoutes())
+	server := &Server{httpTransport: http.DefaultTransport, concurrency: limiters}
+	proxy := &httputil.ReverseProxy{Director: server.Director, Transport: server, FlushInterval: -1}
+	gateway := httptest.NewServer(withRequestContext(proxy))
+	defer gateway.Close()
+
+	resp, err := http.Get(gateway.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if line, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil || line != "data: 1\n" {
+		t.Fatalf("expected the first event, got %q %v", line, err)
+	}
+
+	// the stream outlives the timeout of the adaptive limit
+	time.Sleep(100 * time.Millisecond)
+	routes, _ := limiters.states()
+	if state := routes[loadRoutes().routes[0].ID()]; state.InFlight != 0 || state.Limit < 5 {
+		t.Errorf("expected the stream's slot back without shrinking the limit, got %+v", state)
+	}
+}
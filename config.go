@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"time"
+)
+
+// Config is everything the gateway reads at startup. There is no in-process
+// reload: a SIGHUP forks a child which loads the config file again.
+type Config struct {
+	Port int        `json:"port"`
+	TLS  *TLSConfig `json:"tls"`
+
+	ClientIP ClientIPConfig `json:"client_ip"`
+
+	Admin AdminConfig `json:"admin"`
+
+	Routes []RouteSpec `json:"routes"`
+
+	RateLimit *RateLimitConfig `json:"rate_limit"`
+
+	Consumers []Consumer   `json:"consumers"`
+	Quota     *QuotaConfig `json:"quota"`
+
+	IdentityGrants []IdentityGrant `json:"identity_grants"`
+
+	// Policies maps policy names to the files holding their CEL expression.
+	Policies map[string]string `json:"policies"`
+
+	// AccessLog logs every proxied request, nil disables it.
+	AccessLog *AccessLogConfig `json:"access_log"`
+
+	// Tracing exports OpenTelemetry spans, nil only passes the trace context on.
+	Tracing *TracingConfig `json:"tracing"`
+
+	// Grpc configures the connections to gRPC upstreams.
+	Grpc *GrpcPoolConfig `json:"grpc"`
+
+	// PriorityClasses decide which requests the concurrency limits shed first.
+	PriorityClasses []PriorityClass `json:"priority_classes"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Port:   8080,
+		Routes: registeredRoutes,
+		RateLimit: &RateLimitConfig{
+			Rules: []RateLimitRule{
+				{
+					Name:        "localhost",
+					Descriptors: []RateLimitDescriptor{{Key: "client_ip", Value: "127.0.0.1"}},
+					Rate:        100,
+					Burst:       100,
+				},
+			},
+		},
+	}
+}
+
+// LoadConfig reads a json config file. Fields missing from the file keep their
+// defaults, an empty path returns the default config.
+func LoadConfig(path string) (*Config, error) {
+	def := defaultConfig()
+	if path == "" {
+		return def, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can not read config %s: %v", path, err)
+	}
+
+	cfg := &Config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("can not parse config %s: %v", path, err)
+	}
+
+	if cfg.Port == 0 {
+		cfg.Port = def.Port
+	}
+	if cfg.Routes == nil {
+		cfg.Routes = def.Routes
+	}
+	if cfg.RateLimit == nil {
+		cfg.RateLimit = def.RateLimit
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", path, err)
+	}
+
+	return cfg, nil
+}
+
+// Validate checks the routes and consumers. The admin API applies changes only if
+// the resulting config passes, like a loaded one.
+func (c *Config) Validate() error {
+	names := make(map[string]bool)
+	hosts := make(map[string]*ConcurrencyConfig)
+	for i := range c.Routes {
+		route := &c.Routes[i]
+		if err := c.validateRoute(route); err != nil {
+			return fmt.Errorf("route %s: %v", route.ID(), err)
+		}
+		if route.Name != "" {
+			if names[route.Name] {
+				return fmt.Errorf("duplicate route name %s", route.Name)
+			}
+			names[route.Name] = true
+		}
+		// the routes share the limiter of a host
+		for _, u := range route.Upstreams {
+			if u.Concurrency == nil {
+				continue
+			}
+			if other, ok := hosts[u.Host]; ok && !reflect.DeepEqual(other, u.Concurrency) {
+				return fmt.Errorf("route %s: upstream %s: concurrency differs from another route's", route.ID(), u.Host)
+			}
+			hosts[u.Host] = u.Concurrency
+		}
+	}
+
+	if c.RateLimit != nil {
+		if err := validateRateLimitRules(c.RateLimit.Rules); err != nil {
+			return fmt.Errorf("rate_limit: %v", err)
+		}
+	}
+
+	consumers := make(map[string]bool)
+	for _, consumer := range c.Consumers {
+		if consumer.Name == "" {
+			return fmt.Errorf("consumer without name")
+		}
+		if consumers[consumer.Name] {
+			return fmt.Errorf("duplicate consumer %s", consumer.Name)
+		}
+		consumers[consumer.Name] = true
+
+		if consumer.Plan != "" {
+			if c.Quota == nil {
+				return fmt.Errorf("consumer %s: plan %s but no quota config", consumer.Name, consumer.Plan)
+			}
+			if _, ok := c.Quota.Plans[consumer.Plan]; !ok {
+				return fmt.Errorf("consumer %s: unknown plan %s", consumer.Name, consumer.Plan)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *Config) validateRoute(route *RouteSpec) error {
+	reg, err := regexp.Compile(route.Path)
+	if err != nil {
+		return fmt.Errorf("invalid path: %v", err)
+	}
+
+	if len(route.Upstreams) == 0 {
+		return fmt.Errorf("no upstreams")
+	}
+	for _, u := range route.Upstreams {
+		if err := validateUpstream(&u); err != nil {
+			return err
+		}
+		// Director forwards the first group of the path to http upstreams
+		if u.Schema != "grpc" && reg.NumSubexp() < 1 {
+			return fmt.Errorf("path needs a group to forward to upstream %s", u.Host)
+		}
+	}
+
+	for _, name := range route.Filters {
+		if _, ok := registeredFilters[name]; !ok {
+			return fmt.Errorf("unknown filter %s", name)
+		}
+	}
+
+	if route.Policy != "" {
+		if _, ok := c.Policies[route.Policy]; !ok {
+			return fmt.Errorf("unknown policy %s", route.Policy)
+		}
+	}
+
+	if err := validateRateLimitRules(route.RateLimits); err != nil {
+		return err
+	}
+
+	if route.Concurrency != nil && route.Concurrency.MaxConcurrency <= 0 {
+		return fmt.Errorf("max_concurrency must be positive")
+	}
+
+	if route.IPAccess != nil {
+		if err := route.IPAccess.Validate(); err != nil {
+			return fmt.Errorf("ip_access: %v", err)
+		}
+	}
+
+	if route.CORS != nil {
+		if err := route.CORS.Validate(); err != nil {
+			return fmt.Errorf("cors: %v", err)
+		}
+	}
+
+	if rate := route.AccessLogSampleRate; rate != nil && (*rate < 0 || *rate > 1) {
+		return fmt.Errorf("access_log_sample_rate must be between 0 and 1")
+	}
+
+	return nil
+}
+
+func validateRateLimitRules(rules []RateLimitRule) error {
+	for _, rule := range rules {
+		if rule.Rate <= 0 || rule.Burst <= 0 {
+			return fmt.Errorf("rate limit %s: rate and burst must be positive", rule.Name)
+		}
+	}
+	return nil
+}
+
+func validateUpstream(u *Upstream) error {
+	if u.Host == "" {
+		return fmt.Errorf("upstream without host")
+	}
+	switch u.Schema {
+	case "http", "https":
+	case "grpc":
+		if u.GrpcEndPoint == "" && !u.Transcode {
+			return fmt.Errorf("grpc upstream %s without grpc_endpoint", u.Host)
+		}
+	default:
+		return fmt.Errorf("upstream %s: unknown schema %q", u.Host, u.Schema)
+	}
+	if u.Transcode && u.Schema != "grpc" {
+		return fmt.Errorf("upstream %s: only grpc upstreams are transcoded", u.Host)
+	}
+	if len(u.Protosets) > 0 || len(u.ProtoFiles) > 0 {
+		if u.Schema != "grpc" {
+			return fmt.Errorf("upstream %s: descriptors are only used by grpc upstreams", u.Host)
+		}
+		if len(u.Protosets) > 0 && len(u.ProtoFiles) > 0 {
+			return fmt.Errorf("upstream %s: protosets and proto_files can not be combined", u.Host)
+		}
+	}
+	if u.Concurrency != nil && u.Concurrency.MaxConcurrency <= 0 {
+		return fmt.Errorf("upstream %s: max_concurrency must be positive", u.Host)
+	}
+	return nil
+}
+
+// Duration is a time.Duration written like "1.5s" in the config file.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"1s\": %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
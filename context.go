@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+type requestContextKey struct{}
+
+// requestContext is the per request state shared by the handlers, Director, filters
+// and transports. httputil.ReverseProxy keeps the context of the incoming request, so
+// everything sees the same pointer.
+type requestContext struct {
+	// method and path as the client sent them, Director rewrites the outgoing request.
+	method string
+	path   string
+
+	clientIP  net.IP
+	requestID string
+	route     *RouteSpec
+	upstream  *Upstream
+	identity  *Identity
+
+	// filterDuration is the time spent in filters, upstreamDuration in the upstream
+	// round trips. retries counts the round trips after the first one.
+	filterDuration   time.Duration
+	upstreamDuration time.Duration
+	retries          int
+
+	// timeout is nil for requests without one.
+	timeout *requestTimeout
+
+	// responseHeader is set on the response after the POST filters ran.
+	responseHeader http.Header
+}
+
+func withRequestContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := &requestContext{
+			method:   r.Method,
+			path:     cleanPath(r.URL.Path),
+			clientIP: clientIPResolver.Resolve(r),
+			identity: identityFromTLS(r.TLS),
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestContextKey{}, rc)))
+	})
+}
+
+// getRequestContext never returns nil, requests which did not go through
+// withRequestContext get an empty one.
+func getRequestContext(r *http.Request) *requestContext {
+	if rc, ok := r.Context().Value(requestContextKey{}).(*requestContext); ok {
+		return rc
+	}
+	return &requestContext{}
+}
+
+// RequestMethodAndPath returns the method and path the client sent, the path cleaned
+// of "." and ".." segments and repeated slashes so that rules match what upstreams
+// resolve it to.
+func RequestMethodAndPath(r *http.Request) (string, string) {
+	rc := getRequestContext(r)
+	if rc.method == "" {
+		return r.Method, cleanPath(r.URL.Path)
+	}
+	return rc.method, rc.path
+}
+
+// cleanPath is path.Clean keeping the trailing slash.
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	clean := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
+// RequestRoute returns the route Director matched, nil if none.
+func RequestRoute(r *http.Request) *RouteSpec {
+	return getRequestContext(r).route
+}
+
+// ResponseHeader returns headers which will be set on the response to the client,
+// whether it comes from the upstream or from an Abort.
+func ResponseHeader(r *http.Request) http.Header {
+	rc := getRequestContext(r)
+	if rc.responseHeader == nil {
+		rc.responseHeader = make(http.Header)
+	}
+	return rc.responseHeader
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+func init() {
+	registeredFilters["cors"] = &CORSFilter{}
+}
+
+type CORSPolicy struct {
+	// AllowOrigins are exact origins, "*" for any origin, or origins with "*"
+	// wildcards such as "https://*.example.com".
+	AllowOrigins []string `json:"allow_origins"`
+	// AllowOriginRegexps must match the whole origin.
+	AllowOriginRegexps []string `json:"allow_origin_regexps"`
+
+	// AllowMethods defaults to GET, HEAD and POST.
+	AllowMethods []string `json:"allow_methods"`
+	// AllowHeaders lists the request headers a preflight may ask for, "*" allows
+	// whatever is asked.
+	AllowHeaders     []string `json:"allow_headers"`
+	ExposeHeaders    []string `json:"expose_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	// MaxAge is how many seconds browsers may cache a preflight, 0 leaves it to them.
+	MaxAge int `json:"max_age"`
+
+	once      sync.Once
+	anyOrigin bool
+	origins   map[string]bool
+	regexps   []*regexp.Regexp
+}
+
+// Validate rejects regexps which do not compile and credentials for any origin, which
+// would hand them to every site.
+func (p *CORSPolicy) Validate() error {
+	for _, expr := range p.AllowOriginRegexps {
+		if _, err := regexp.Compile(originRegexp(expr)); err != nil {
+			return fmt.Errorf("invalid origin regexp %q: %v", expr, err)
+		}
+	}
+	if p.AllowCredentials && containsString(p.AllowOrigins, "*") {
+		return fmt.Errorf(`allow_credentials can not be combined with the "*" origin`)
+	}
+	return nil
+}
+
+func originRegexp(expr string) string {
+	return "^(?:" + expr + ")$"
+}
+
+func (p *CORSPolicy) compile() {
+	p.origins = make(map[string]bool)
+	for _, o := range p.AllowOrigins {
+		switch {
+		case o == "*":
+			p.anyOrigin = true
+		case strings.Contains(o, "*"):
+			expr := "^" + strings.Replace(regexp.QuoteMeta(strings.ToLower(o)), `\*`, `[a-z0-9.-]+`, -1) + "$"
+			p.regexps = append(p.regexps, regexp.MustCompile(expr))
+		default:
+			p.origins[strings.ToLower(o)] = true
+		}
+	}
+
+	for _, expr := range p.AllowOriginRegexps {
+		reg, err := regexp.Compile(originRegexp(expr))
+		if err != nil {
+			log.Printf("cors: invalid origin regexp %q, ignore: %v", expr, err)
+			continue
+		}
+		p.regexps = append(p.regexps, reg)
+	}
+}
+
+func (p *CORSPolicy) AllowsOrigin(origin string) bool {
+	p.once.Do(p.compile)
+
+	if p.anyOrigin {
+		return true
+	}
+
+	origin = strings.ToLower(origin)
+	if p.origins[origin] {
+		return true
+	}
+	for _, reg := range p.regexps {
+		if reg.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *CORSPolicy) allowsMethod(method string) bool {
+	methods := p.AllowMethods
+	if len(methods) == 0 {
+		methods = []string{"GET", "HEAD", "POST"}
+	}
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedHeaders returns the value of Access-Control-Allow-Headers for the headers a
+// preflight asked for, false if one of them is not allowed.
+func (p *CORSPolicy) allowedHeaders(requested string) (string, bool) {
+	if requested == "" {
+		return "", true
+	}
+	if containsString(p.AllowHeaders, "*") {
+		return requested, true
+	}
+
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.TrimSpace(h)
+		found := false
+		for _, allowed := range p.AllowHeaders {
+			if strings.EqualFold(allowed, h) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", false
+		}
+	}
+	return requested, true
+}
+
+func (p *CORSPolicy) setOrigin(h http.Header, origin string) {
+	if p.anyOrigin && !p.AllowCredentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Add("Vary", "Origin")
+	}
+	if p.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// CORSFilter answers preflight requests itself and adds the CORS headers to the
+// responses of actual requests. Requests from origins which are not allowed are
+// proxied without CORS headers, so browsers will refuse them.
+type CORSFilter struct{}
+
+func (f *CORSFilter) GetType() string {
+	return "PRE"
+}
+
+func (f *CORSFilter) GetOrder() int {
+	// before authentication, preflights carry no credentials.
+	return -10
+}
+
+func (f *CORSFilter) ShouldFilter(r *http.Request) (bool, error) {
+	route := RequestRoute(r)
+	return route != nil && route.CORS != nil && r.Header.Get("Origin") != "", nil
+}
+
+func (f *CORSFilter) Run(r *http.Request) error {
+	policy := RequestRoute(r).CORS
+	origin := r.Header.Get("Origin")
+	method, _ := RequestMethodAndPath(r)
+
+	requestedMethod := r.Header.Get("Access-Control-Request-Method")
+	if method == http.MethodOptions && requestedMethod != "" {
+		return f.preflight(policy, origin, requestedMethod, r.Header.Get("Access-Control-Request-Headers"))
+	}
+
+	if !policy.AllowsOrigin(origin) {
+		// the answer still depends on the origin
+		ResponseHeader(r).Add("Vary", "Origin")
+		return nil
+	}
+
+	h := ResponseHeader(r)
+	policy.setOrigin(h, origin)
+	if len(policy.ExposeHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(policy.ExposeHeaders, ", "))
+	}
+	return nil
+}
+
+func (f *CORSFilter) preflight(policy *CORSPolicy, origin, method, headers string) error {
+	if !policy.AllowsOrigin(origin) {
+		return &Abort{StatusCode: http.StatusForbidden, Message: "origin not allowed"}
+	}
+	if !policy.allowsMethod(method) {
+		return &Abort{StatusCode: http.StatusForbidden, Message: "method not allowed"}
+	}
+	allowedHeaders, ok := policy.allowedHeaders(headers)
+	if !ok {
+		return &Abort{StatusCode: http.StatusForbidden, Message: "headers not allowed"}
+	}
+
+	h := make(http.Header)
+	policy.setOrigin(h, origin)
+	h.Set("Access-Control-Allow-Methods", method)
+	if allowedHeaders != "" {
+		h.Set("Access-Control-Allow-Headers", allowedHeaders)
+	}
+	if policy.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(policy.MaxAge))
+	}
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+
+	return &Abort{StatusCode: http.StatusNoContent, Header: h}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCORSAllowsOrigin(t *testing.T) {
+	policy := &CORSPolicy{
+		AllowOrigins:       []string{"https://app.example.com", "https://*.example.org"},
+		AllowOriginRegexps: []string{`https://app\.example\.net`, `http://localhost:\d+`},
+	}
+	cases := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.com", true},
+		{"HTTPS://APP.EXAMPLE.COM", true},
+		{"https://other.example.com", false},
+		{"https://a.example.org", true},
+		{"https://a.b.example.org", true},
+		{"https://example.org", false},
+		{"https://a.example.org.evil.net", false},
+		{"https://app.example.net", true},
+		{"https://app.example.net.evil.net", false},
+		{"https://evil.net/https://app.example.net", false},
+		{"http://localhost:8080", true},
+		{"http://localhost:8080.evil.net", false},
+	}
+	for _, c := range cases {
+		if got := policy.AllowsOrigin(c.origin); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.origin, got, c.want)
+		}
+	}
+
+	if !(&CORSPolicy{AllowOrigins: []string{"*"}}).AllowsOrigin("https://anything.net") {
+		t.Error("expected * to allow any origin")
+	}
+}
+
+func TestCORSPolicyValidate(t *testing.T) {
+	cases := []struct {
+		policy *CORSPolicy
+		valid  bool
+	}{
+		{&CORSPolicy{AllowOrigins: []string{"https://app.example.com"}, AllowCredentials: true}, true},
+		{&CORSPolicy{AllowOrigins: []string{"*"}}, true},
+		{&CORSPolicy{AllowOrigins: []string{"*"}, AllowCredentials: true}, false},
+		{&CORSPolicy{AllowOriginRegexps: []string{`https://(app`}}, false},
+	}
+	for _, c := range cases {
+		if err := c.policy.Validate(); (err == nil) != c.valid {
+			t.Errorf("%+v: expected valid %v, got %v", c.policy, c.valid, err)
+		}
+	}
+
+	cfg := defaultConfig()
+	cfg.Routes = []RouteSpec{{
+		Path:      "^/app/(.*)",
+		Upstreams: []Upstream{{Host: "127.0.0.1:8080", Schema: "http"}},
+		CORS:      &CORSPolicy{AllowOriginRegexps: []string{`[`}},
+	}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected the config to reject an invalid origin regexp")
+	}
+}
+
+// runCORS runs the filter for a request from origin and returns the abort it answered
+// with, if any, and the headers set on the response.
+func runCORS(policy *CORSPolicy, method, origin string, header http.Header) (*Abort, http.Header) {
+	r := httptest.NewRequest(method, "/app/items", nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Origin", origin)
+	rc := &requestContext{method: method, path: "/app/items", route: &RouteSpec{CORS: policy}}
+	r = r.WithContext(context.WithValue(r.Context(), requestContextKey{}, rc))
+
+	f := &CORSFilter{}
+	if ok, _ := f.ShouldFilter(r); !ok {
+		return nil, nil
+	}
+	abort, _ := f.Run(r).(*Abort)
+	return abort, rc.responseHeader
+}
+
+func TestCORSFilterPreflight(t *testing.T) {
+	policy := &CORSPolicy{
+		AllowOrigins:     []string{"https://app.example.com"},
+		AllowMethods:     []string{"GET", "PUT"},
+		AllowHeaders:     []string{"Content-Type", "X-Token"},
+		AllowCredentials: true,
+		MaxAge:           600,
+	}
+	preflight := func(origin, method, headers string) *Abort {
+		h := http.Header{"Access-Control-Request-Method": {method}}
+		if headers != "" {
+			h.Set("Access-Control-Request-Headers", headers)
+		}
+		abort, _ := runCORS(policy, http.MethodOptions, origin, h)
+		return abort
+	}
+
+	ok := preflight("https://app.example.com", "PUT", "content-type, x-token")
+	if ok == nil || ok.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected the preflight to be answered with 204, got %+v", ok)
+	}
+	want := http.Header{
+		"Access-Control-Allow-Origin":      {"https://app.example.com"},
+		"Access-Control-Allow-Credentials": {"true"},
+		"Access-Control-Allow-Methods":     {"PUT"},
+		"Access-Control-Allow-Headers":     {"content-type, x-token"},
+		"Access-Control-Max-Age":           {"600"},
+		"Vary":                             {"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"},
+	}
+	if !reflect.DeepEqual(ok.Header, want) {
+		t.Errorf("expected %v, got %v", want, ok.Header)
+	}
+
+	for _, c := range []struct{ origin, method, headers string }{
+		{"https://evil.net", "PUT", ""},
+		{"https://app.example.com", "DELETE", ""},
+		{"https://app.example.com", "PUT", "X-Other"},
+	} {
+		if abort := preflight(c.origin, c.method, c.headers); abort == nil || abort.StatusCode != http.StatusForbidden {
+			t.Errorf("%+v: expected the preflight to be refused, got %+v", c, abort)
+		}
+	}
+}
+
+func TestCORSFilterActualRequest(t *testing.T) {
+	policy := &CORSPolicy{AllowOrigins: []string{"https://app.example.com"}, ExposeHeaders: []string{"X-Total"}}
+
+	abort, h := runCORS(policy, "GET", "https://app.example.com", nil)
+	if abort != nil || h.Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		h.Get("Access-Control-Expose-Headers") != "X-Total" || h.Get("Vary") != "Origin" {
+		t.Errorf("expected the CORS headers of an allowed origin, got %v %v", abort, h)
+	}
+
+	// refused by the browser, but caches must not reuse it for allowed origins
+	abort, h = runCORS(policy, "GET", "https://evil.net", nil)
+	if abort != nil || h.Get("Access-Control-Allow-Origin") != "" || h.Get("Vary") != "Origin" {
+		t.Errorf("expected only Vary for a disallowed origin, got %v %v", abort, h)
+	}
+
+	_, h = runCORS(&CORSPolicy{AllowOrigins: []string{"*"}}, "GET", "https://any.net", nil)
+	if h.Get("Access-Control-Allow-Origin") != "*" || h.Get("Vary") != "" {
+		t.Errorf("expected * without Vary for any origin, got %v", h)
+	}
+}
+
+func TestCORSKeepsUpstreamVary(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", r.URL.Query().Get("vary"))
+	}))
+	defer upstream.Close()
+
+	defer currentRoutes.Store(loadRoutes())
+	setRoutes([]RouteSpec{{
+		Path:      "^/app/(.*)",
+		Upstreams: []Upstream{{Host: strings.TrimPrefix(upstream.URL, "http://"), Schema: "http"}},
+		Filters:   []string{"cors"},
+		CORS:      &CORSPolicy{AllowOrigins: []string{"https://app.example.com"}},
+	}})
+
+	server := &Server{httpTransport: http.DefaultTransport}
+	proxy := &httputil.ReverseProxy{Director: server.Director, Transport: server}
+	gateway := httptest.NewServer(withRequestContext(proxy))
+	defer gateway.Close()
+
+	req, _ := http.NewRequest("GET", gateway.URL+"/app/items?vary=Accept-Encoding,+origin", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Values("Vary"); !reflect.DeepEqual(got, []string{"Accept-Encoding, origin"}) {
+		t.Errorf("expected the upstream's Vary, got %v", got)
+	}
+	if resp.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Errorf("expected the CORS headers, got %v", resp.Header)
+	}
+
+	req, _ = http.NewRequest("GET", gateway.URL+"/app/items?vary=Accept-Encoding", nil)
+	req.Header.Set("Origin", "https://evil.net")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Values("Vary"); !reflect.DeepEqual(got, []string{"Accept-Encoding", "Origin"}) {
+		t.Errorf("expected Origin added to the upstream's Vary, got %v", got)
+	}
+}
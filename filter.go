@@ -1,6 +1,12 @@
 package main
 
-import "net/http"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
 
 const filtersHeaderKey = "MINI-GATEWAY-FILTERS"
 
@@ -21,3 +27,59 @@ type PostFilter interface {
 	Filter
 	Run(r *http.Request, resp *http.Response, upstreamError error) error
 }
+
+// Abort is returned by a PRE filter to answer the request itself instead of
+// forwarding it upstream. Any other error a PRE filter returns is answered with 500.
+type Abort struct {
+	StatusCode int
+	Message    string
+	Header     http.Header
+}
+
+func (a *Abort) Error() string {
+	return fmt.Sprintf("%d %s", a.StatusCode, a.Message)
+}
+
+func (a *Abort) response(r *http.Request) *http.Response {
+	header := make(http.Header)
+	for k, v := range a.Header {
+		header[k] = v
+	}
+
+	var body []byte
+	if a.Message != "" {
+		fields := map[string]interface{}{
+			"code":    a.StatusCode,
+			"message": a.Message,
+		}
+		if id := RequestID(r); id != "" {
+			fields["request_id"] = id
+		}
+		body, _ = json.Marshal(fields)
+		header.Set("Content-Type", "application/json")
+	}
+
+	return newResponse(r, a.StatusCode, header, body)
+}
+
+// newResponse is a response the gateway answers r with itself.
+func newResponse(r *http.Request, code int, header http.Header, body []byte) *http.Response {
+	return &http.Response{
+		StatusCode:    code,
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}
+}
+
+func toAbort(err error) *Abort {
+	if a, ok := err.(*Abort); ok {
+		return a
+	}
+	return &Abort{StatusCode: http.StatusInternalServerError, Message: "gateway error"}
+}
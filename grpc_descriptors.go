@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/fullstorydev/grpcurl"
+	"github.com/jhump/protoreflect/grpcreflect"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/metadata"
+	reflectpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultDescriptorTTL = 5 * time.Minute
+
+// descriptorCache keeps a reflection client per target. The client remembers the
+// files it fetched, so only the first call of a method asks the upstream for its
+// descriptors.
+type descriptorCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*descriptorEntry
+}
+
+type descriptorEntry struct {
+	source  grpcurl.DescriptorSource
+	client  *grpcreflect.Client
+	cc      *grpc.ClientConn
+	expires time.Time
+
+	// transcoder is built from source on first use.
+	transcoderOnce sync.Once
+	transcoder     *transcoder
+	transcoderErr  error
+}
+
+func newDescriptorCache(ttl time.Duration) *descriptorCache {
+	if ttl <= 0 {
+		ttl = defaultDescriptorTTL
+	}
+	return &descriptorCache{ttl: ttl, entries: make(map[string]*descriptorEntry)}
+}
+
+// get returns the descriptor source of target, cached reports whether it was
+// already used by earlier calls.
+func (c *descriptorCache) get(target string, cc *grpc.ClientConn) (source grpcurl.DescriptorSource, cached bool) {
+	e, cached := c.entry(target, cc)
+	return e.source, cached
+}
+
+// transcoder returns the transcoder of the methods target reflects.
+func (c *descriptorCache) transcoder(target string, cc *grpc.ClientConn) (*transcoder, error) {
+	e, _ := c.entry(target, cc)
+	// built outside c.mu, it takes a few round trips
+	e.transcoderOnce.Do(func() {
+		e.transcoder, e.transcoderErr = newTranscoder(e.source)
+	})
+	if e.transcoderErr != nil {
+		c.invalidate(target)
+		return nil, e.transcoderErr
+	}
+	return e.transcoder, nil
+}
+
+func (c *descriptorCache) entry(target string, cc *grpc.ClientConn) (*descriptorEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[target]
+	if ok && (time.Now().After(e.expires) || e.cc.GetState() == connectivity.Shutdown) {
+		e.client.Reset()
+		ok = false
+	}
+	if ok {
+		return e, true
+	}
+
+	// the reflection stream outlives the request which opened it
+	ctx := metadata.NewOutgoingContext(context.Background(), grpcurl.MetadataFromHeaders([]string{}))
+	client := grpcreflect.NewClient(ctx, reflectpb.NewServerReflectionClient(cc))
+	e = &descriptorEntry{
+		source:  grpcurl.DescriptorSourceFromServer(ctx, client),
+		client:  client,
+		cc:      cc,
+		expires: time.Now().Add(c.ttl),
+	}
+	c.entries[target] = e
+	return e, false
+}
+
+func (c *descriptorCache) invalidate(target string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[target]; ok {
+		e.client.Reset()
+		delete(c.entries, target)
+	}
+}
+
+// flush drops all descriptors, the next call to each target reflects again.
+func (c *descriptorCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for target, e := range c.entries {
+		e.client.Reset()
+		delete(c.entries, target)
+	}
+}
+
+// loadDescriptors reads the Protosets or ProtoFiles of u, once.
+func (u *Upstream) loadDescriptors() error {
+	if u.descriptors != nil {
+		return nil
+	}
+
+	var err error
+	switch {
+	case len(u.Protosets) > 0:
+		u.descriptors, err = grpcurl.DescriptorSourceFromProtoSets(u.Protosets...)
+	case len(u.ProtoFiles) > 0:
+		u.descriptors, err = grpcurl.DescriptorSourceFromProtoFiles(u.ImportPaths, u.ProtoFiles...)
+	}
+	if err != nil {
+		return fmt.Errorf("upstream %s: can not load descriptors: %v", u.Host, err)
+	}
+
+	if u.Transcode && u.descriptors != nil {
+		if u.transcoder, err = newTranscoder(u.descriptors); err != nil {
+			return fmt.Errorf("upstream %s: %v", u.Host, err)
+		}
+	}
+	return nil
+}
+
+// isUnknownMethod tells whether a call failed because the method is missing from the
+// descriptors, which may be older than the upstream. The call was not sent, so it can
+// be retried. An UNIMPLEMENTED status is no such failure, the method itself may have
+// returned it.
+func isUnknownMethod(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "does not expose service") || strings.Contains(msg, "does not include a method named")
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/base64"
+	"google.golang.org/grpc/metadata"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type GrpcMetadataConfig struct {
+	// Allow lists the request headers sent to upstreams as metadata, names or
+	// prefixes ending in "*". Defaults to Authorization and Grpc-Metadata-*.
+	Allow []string `json:"allow"`
+	// Deny wins over Allow.
+	Deny []string `json:"deny"`
+	// Rename maps header prefixes to metadata prefixes, "Grpc-Metadata-": "" by
+	// default. The longest matching prefix is used.
+	Rename map[string]string `json:"rename"`
+
+	// ResponseHeaderPrefix and ResponseTrailerPrefix are put before the names of the
+	// response metadata, Grpc-Metadata- and Grpc-Trailer- by default.
+	ResponseHeaderPrefix  string `json:"response_header_prefix"`
+	ResponseTrailerPrefix string `json:"response_trailer_prefix"`
+}
+
+// reservedMetadata are the metadata keys never taken from request headers, they
+// describe the HTTP request or are set by grpc itself.
+var reservedMetadata = []string{
+	"connection", "keep-alive", "proxy-*", "te", "trailer", "transfer-encoding", "upgrade",
+	"host", "content-length", "content-type", "accept-encoding", "user-agent", "grpc-*",
+}
+
+type metadataRules struct {
+	allow, deny []string
+	rename      map[string]string
+
+	headerPrefix, trailerPrefix string
+}
+
+func newMetadataRules(cfg *GrpcMetadataConfig) *metadataRules {
+	m := &metadataRules{
+		allow:         []string{"Authorization", "Grpc-Metadata-*"},
+		rename:        map[string]string{"Grpc-Metadata-": ""},
+		headerPrefix:  "Grpc-Metadata-",
+		trailerPrefix: "Grpc-Trailer-",
+	}
+	if cfg == nil {
+		return m
+	}
+	if cfg.Allow != nil {
+		m.allow = cfg.Allow
+	}
+	m.deny = cfg.Deny
+	if cfg.Rename != nil {
+		m.rename = cfg.Rename
+	}
+	if cfg.ResponseHeaderPrefix != "" {
+		m.headerPrefix = cfg.ResponseHeaderPrefix
+	}
+	if cfg.ResponseTrailerPrefix != "" {
+		m.trailerPrefix = cfg.ResponseTrailerPrefix
+	}
+	return m
+}
+
+// matchHeader tells whether name is one of patterns, names or prefixes ending in "*".
+func matchHeader(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "*") {
+			if len(name) >= len(p)-1 && strings.EqualFold(name[:len(p)-1], p[:len(p)-1]) {
+				return true
+			}
+		} else if strings.EqualFold(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// fromHeader returns the metadata header sends to upstreams.
+func (m *metadataRules) fromHeader(header http.Header) metadata.MD {
+	md := metadata.MD{}
+	for name, values := range header {
+		if !matchHeader(m.allow, name) || matchHeader(m.deny, name) {
+			continue
+		}
+		key := m.key(name)
+		if !validMetadataKey(key) || matchHeader(reservedMetadata, key) {
+			continue
+		}
+		for _, v := range values {
+			// grpc refuses the call for metadata it can not send, binary values are
+			// base64 encoded by it
+			if strings.HasSuffix(key, "-bin") || printableASCII(v) {
+				md.Append(key, v)
+			}
+		}
+	}
+	return md
+}
+
+func validMetadataKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func printableASCII(v string) bool {
+	for i := 0; i < len(v); i++ {
+		if v[i] < 0x20 || v[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *metadataRules) key(name string) string {
+	longest := ""
+	for from := range m.rename {
+		if len(from) > len(longest) && len(name) >= len(from) && strings.EqualFold(name[:len(from)], from) {
+			longest = from
+		}
+	}
+	if longest != "" {
+		name = m.rename[longest] + name[len(longest):]
+	}
+	return strings.ToLower(name)
+}
+
+// toHeader adds the response headers and trailers of a call to header.
+func (m *metadataRules) toHeader(header http.Header, respHeader, respTrailer metadata.MD) {
+	add := func(prefix string, md metadata.MD) {
+		for key, values := range responseMetadata(md) {
+			for _, v := range values {
+				header.Add(prefix+key, v)
+			}
+		}
+	}
+	add(m.headerPrefix, respHeader)
+	add(m.trailerPrefix, respTrailer)
+}
+
+// responseMetadata returns the metadata of a response clients get to see, values of
+// binary keys base64 encoded.
+func responseMetadata(md metadata.MD) map[string][]string {
+	out := make(map[string][]string)
+	for key, values := range md {
+		if key == "content-type" || strings.HasPrefix(key, "grpc-") {
+			continue
+		}
+		for _, v := range values {
+			if strings.HasSuffix(key, "-bin") {
+				v = base64.StdEncoding.EncodeToString([]byte(v))
+			}
+			out[key] = append(out[key], v)
+		}
+	}
+	return out
+}
+
+// headerLines turns md into the "name: value" lines grpcurl sends. Values of binary
+// keys stay base64 encoded, grpcurl decodes them.
+func headerLines(md metadata.MD) []string {
+	var lines []string
+	for key, values := range md {
+		for _, v := range values {
+			lines = append(lines, key+": "+v)
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+type GrpcPoolConfig struct {
+	// Size is the number of connections per target, defaults to 1. One HTTP/2
+	// connection carries many concurrent calls, more help with very busy targets.
+	Size int `json:"size"`
+	// IdleTimeout closes the connections of targets unused for that long, defaults
+	// to 10m.
+	IdleTimeout Duration `json:"idle_timeout"`
+
+	Keepalive *GrpcKeepaliveConfig `json:"keepalive"`
+
+	// DescriptorTTL is how long the descriptors reflected from an upstream are
+	// used, defaults to 5m.
+	DescriptorTTL Duration `json:"descriptor_ttl"`
+
+	// Metadata decides which request headers reach the upstreams.
+	Metadata *GrpcMetadataConfig `json:"metadata"`
+
+	// Targets holds dial options per upstream host.
+	Targets map[string]GrpcTargetConfig `json:"targets"`
+}
+
+type GrpcKeepaliveConfig struct {
+	// Time between pings on idle connections, Timeout to wait for the ack.
+	Time                Duration `json:"time"`
+	Timeout             Duration `json:"timeout"`
+	PermitWithoutStream bool     `json:"permit_without_stream"`
+}
+
+type GrpcTargetConfig struct {
+	// Size overrides GrpcPoolConfig.Size.
+	Size int `json:"size"`
+
+	// TLS connects with TLS, verified against CAFile or the system roots.
+	TLS        bool   `json:"tls"`
+	CAFile     string `json:"ca_file"`
+	ServerName string `json:"server_name"`
+
+	// Authority overrides the :authority of the calls.
+	Authority      string `json:"authority"`
+	MaxRecvMsgSize int    `json:"max_recv_msg_size"`
+}
+
+// grpcConnPool keeps a few connections per target and hands them out round robin.
+// gRPC reconnects a connection by itself, the pool replaces the ones which were shut
+// down and closes the ones of targets not used for a while.
+type grpcConnPool struct {
+	cfg GrpcPoolConfig
+
+	mu      sync.Mutex
+	targets map[string]*grpcTargetPool
+
+	// dial is grpc.NewClient, tests replace it.
+	dial func(target string, opts ...grpc.DialOption) (*grpc.ClientConn, error)
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+type grpcTargetPool struct {
+	conns    []*grpc.ClientConn
+	next     int
+	inUse    int
+	lastUsed time.Time
+}
+
+func newGrpcConnPool(cfg *GrpcPoolConfig) *grpcConnPool {
+	p := &grpcConnPool{
+		targets: make(map[string]*grpcTargetPool),
+		dial:    grpc.NewClient,
+		done:    make(chan struct{}),
+	}
+	if cfg != nil {
+		p.cfg = *cfg
+	}
+	if p.cfg.Size <= 0 {
+		p.cfg.Size = 1
+	}
+	if p.cfg.IdleTimeout <= 0 {
+		p.cfg.IdleTimeout = Duration(10 * time.Minute)
+	}
+	return p
+}
+
+func (p *grpcConnPool) size(target string) int {
+	if t, ok := p.cfg.Targets[target]; ok && t.Size > 0 {
+		return t.Size
+	}
+	return p.cfg.Size
+}
+
+func (p *grpcConnPool) dialOptions(target string) ([]grpc.DialOption, error) {
+	var opts []grpc.DialOption
+
+	t := p.cfg.Targets[target]
+	if t.TLS {
+		tlsConfig := &tls.Config{ServerName: t.ServerName}
+		if t.CAFile != "" {
+			pem, err := ioutil.ReadFile(t.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("can not read ca file of %s: %v", target, err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate in ca file %s", t.CAFile)
+			}
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	} else {
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+
+	if t.Authority != "" {
+		opts = append(opts, grpc.WithAuthority(t.Authority))
+	}
+	if t.MaxRecvMsgSize > 0 {
+		opts = append(opts, grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(t.MaxRecvMsgSize)))
+	}
+
+	if ka := p.cfg.Keepalive; ka != nil {
+		opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                time.Duration(ka.Time),
+			Timeout:             time.Duration(ka.Timeout),
+			PermitWithoutStream: ka.PermitWithoutStream,
+		}))
+	}
+
+	return opts, nil
+}
+
+// Get returns a connection to target. release must be called once the call is done,
+// a target with calls in progress is not evicted.
+func (p *grpcConnPool) Get(target string) (*grpc.ClientConn, func(), error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	select {
+	case <-p.done:
+		return nil, nil, fmt.Errorf("grpc connection pool closed")
+	default:
+	}
+
+	t, ok := p.targets[target]
+	if !ok {
+		t = &grpcTargetPool{conns: make([]*grpc.ClientConn, p.size(target))}
+		p.targets[target] = t
+	}
+
+	i := t.next
+	t.next = (t.next + 1) % len(t.conns)
+
+	cc := t.conns[i]
+	if cc != nil {
+		switch cc.GetState() {
+		case connectivity.Shutdown:
+			cc = nil
+		case connectivity.TransientFailure:
+			// try again now rather than after the backoff
+			cc.ResetConnectBackoff()
+		}
+	}
+
+	if cc == nil {
+		// NewClient does not connect, it is cheap enough to do under the lock
+		opts, err := p.dialOptions(target)
+		if err != nil {
+			return nil, nil, err
+		}
+		if cc, err = p.dial(target, opts...); err != nil {
+			return nil, nil, fmt.Errorf("can not dial %s: %v", target, err)
+		}
+		if t.conns[i] == nil {
+			grpcPoolConnections.WithLabelValues(target).Inc()
+		}
+		t.conns[i] = cc
+	}
+
+	t.inUse++
+	t.lastUsed = time.Now()
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			p.mu.Lock()
+			t.inUse--
+			t.lastUsed = time.Now()
+			p.mu.Unlock()
+		})
+	}
+	return cc, release, nil
+}
+
+// evictIdle closes the connections of the targets unused since before now minus
+// IdleTimeout.
+func (p *grpcConnPool) evictIdle(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for target, t := range p.targets {
+		if t.inUse > 0 || now.Sub(t.lastUsed) < time.Duration(p.cfg.IdleTimeout) {
+			continue
+		}
+		p.closeTarget(target, t)
+	}
+}
+
+// closeTarget must be called with p.mu held.
+func (p *grpcConnPool) closeTarget(target string, t *grpcTargetPool) {
+	for _, cc := range t.conns {
+		if cc != nil {
+			cc.Close()
+			grpcPoolConnections.WithLabelValues(target).Dec()
+		}
+	}
+	delete(p.targets, target)
+}
+
+// Run evicts idle targets until the pool is closed.
+func (p *grpcConnPool) Run() {
+	ticker := time.NewTicker(time.Duration(p.cfg.IdleTimeout) / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			p.evictIdle(now)
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// Close closes all connections, calls in progress fail.
+func (p *grpcConnPool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for target, t := range p.targets {
+		p.closeTarget(target, t)
+	}
+}
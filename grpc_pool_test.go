@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func countingDial(p *grpcConnPool, dials *int32) {
+	p.dial = func(target string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+		atomic.AddInt32(dials, 1)
+		return grpc.NewClient(target, opts...)
+	}
+}
+
+func TestGrpcConnPoolConcurrent(t *testing.T) {
+	p := newGrpcConnPool(&GrpcPoolConfig{
+		Size:    2,
+		Targets: map[string]GrpcTargetConfig{"127.0.0.1:9003": {Size: 4}},
+	})
+	defer p.Close()
+	var dials int32
+	countingDial(p, &dials)
+
+	targets := []string{"127.0.0.1:9001", "127.0.0.1:9002", "127.0.0.1:9003"}
+	var wg sync.WaitGroup
+	for i := 0; i < 150; i++ {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			cc, release, err := p.Get(target)
+			if err != nil || cc == nil {
+				t.Errorf("expected a connection to %s, got %v", target, err)
+				return
+			}
+			release()
+			release() // a second release is ignored
+		}(targets[i%len(targets)])
+	}
+	wg.Wait()
+
+	if dials != 2+2+4 {
+		t.Errorf("expected 8 connections, got %d", dials)
+	}
+	for target, tp := range p.targets {
+		if tp.inUse != 0 {
+			t.Errorf("expected no connection to %s in use, got %d", target, tp.inUse)
+		}
+	}
+}
+
+func TestGrpcConnPoolReconnect(t *testing.T) {
+	p := newGrpcConnPool(nil)
+	defer p.Close()
+
+	fail := true
+	p.dial = func(target string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+		if fail {
+			return nil, errors.New("no route to host")
+		}
+		return grpc.NewClient(target, opts...)
+	}
+
+	if _, _, err := p.Get("127.0.0.1:9001"); err == nil {
+		t.Fatal("expected the dial error")
+	}
+	fail = false
+	cc, release, err := p.Get("127.0.0.1:9001")
+	if err != nil {
+		t.Fatalf("expected a failed dial to be retried, got %v", err)
+	}
+	release()
+
+	cc.Close()
+	cc2, release, err := p.Get("127.0.0.1:9001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if cc2 == cc {
+		t.Error("expected a shut down connection to be replaced")
+	}
+}
+
+func TestGrpcConnPoolEvictIdle(t *testing.T) {
+	p := newGrpcConnPool(&GrpcPoolConfig{IdleTimeout: Duration(time.Minute)})
+	defer p.Close()
+
+	idle, release, _ := p.Get("127.0.0.1:9001")
+	release()
+	busy, release, _ := p.Get("127.0.0.1:9002")
+	defer release()
+
+	p.evictIdle(time.Now().Add(30 * time.Second))
+	if len(p.targets) != 2 {
+		t.Fatalf("expected no eviction before the idle timeout, got %d targets", len(p.targets))
+	}
+
+	p.evictIdle(time.Now().Add(2 * time.Minute))
+	if _, ok := p.targets["127.0.0.1:9001"]; ok || idle.GetState() != connectivity.Shutdown {
+		t.Error("expected the idle target to be closed")
+	}
+	if _, ok := p.targets["127.0.0.1:9002"]; !ok || busy.GetState() == connectivity.Shutdown {
+		t.Error("expected the target in use to be kept")
+	}
+
+	p.Close()
+	if _, _, err := p.Get("127.0.0.1:9001"); err == nil {
+		t.Error("expected a closed pool to fail")
+	}
+}
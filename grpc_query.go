@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// queryToJSON adds the query parameters to body, the JSON of a md message which may
+// be empty.
+func queryToJSON(body string, md *desc.MessageDescriptor, query url.Values) (string, error) {
+	msg := make(map[string]interface{})
+	if strings.TrimSpace(body) != "" {
+		if err := unmarshalNumbers([]byte(body), &msg); err != nil {
+			return "", fmt.Errorf("invalid request body: %v", err)
+		}
+	}
+	if err := setQueryFields(msg, md, query); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(msg)
+	return string(data), err
+}
+
+// setQueryFields sets the fields named by the query parameters on msg, the JSON
+// object of a md message. Dotted names address fields of nested messages, repeated
+// names fill repeated fields. Fields msg already has are kept.
+func setQueryFields(msg map[string]interface{}, md *desc.MessageDescriptor, query url.Values) error {
+	// sorted to report the same error for the same query
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := setTypedField(msg, md, name, query[name], false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setTypedField sets the field at the dotted path of msg to values converted to the
+// JSON of the field's type. An existing value is only replaced if overwrite is set.
+func setTypedField(msg map[string]interface{}, md *desc.MessageDescriptor, path string, values []string, overwrite bool) error {
+	names := strings.Split(path, ".")
+	for i, name := range names {
+		fd := findField(md, name)
+		if fd == nil {
+			return fmt.Errorf("unknown field %q in %s", strings.Join(names[:i+1], "."), md.GetFullyQualifiedName())
+		}
+		key := fd.GetJSONName()
+
+		if i < len(names)-1 {
+			if fd.GetType() != descriptorpb.FieldDescriptorProto_TYPE_MESSAGE || fd.IsRepeated() || isWellKnownType(fd.GetMessageType()) {
+				return fmt.Errorf("field %q is not a message", strings.Join(names[:i+1], "."))
+			}
+			next, ok := msg[key].(map[string]interface{})
+			if !ok {
+				next = make(map[string]interface{})
+				msg[key] = next
+			}
+			msg, md = next, fd.GetMessageType()
+			continue
+		}
+
+		if _, exists := msg[key]; exists && !overwrite {
+			return nil
+		}
+		if fd.IsMap() {
+			return fmt.Errorf("map field %q can not be set from the query", path)
+		}
+		if !fd.IsRepeated() {
+			if len(values) > 1 {
+				return fmt.Errorf("field %q is not repeated but has %d values", path, len(values))
+			}
+			v, err := fieldValue(fd, values[0])
+			if err != nil {
+				return fmt.Errorf("field %q: %v", path, err)
+			}
+			msg[key] = v
+			return nil
+		}
+
+		list := make([]interface{}, 0, len(values))
+		for _, s := range values {
+			v, err := fieldValue(fd, s)
+			if err != nil {
+				return fmt.Errorf("field %q: %v", path, err)
+			}
+			list = append(list, v)
+		}
+		msg[key] = list
+	}
+	return nil
+}
+
+// findField finds the field by its proto or JSON name.
+func findField(md *desc.MessageDescriptor, name string) *desc.FieldDescriptor {
+	if fd := md.FindFieldByName(name); fd != nil {
+		return fd
+	}
+	for _, fd := range md.GetFields() {
+		if fd.GetJSONName() == name {
+			return fd
+		}
+	}
+	return nil
+}
+
+func isWellKnownType(md *desc.MessageDescriptor) bool {
+	return strings.HasPrefix(md.GetFullyQualifiedName(), "google.protobuf.")
+}
+
+// fieldValue converts s to the JSON value of a single fd, as protobuf's JSON mapping
+// wants it: 64 bit integers as strings, timestamps in RFC 3339.
+func fieldValue(fd *desc.FieldDescriptor, s string) (interface{}, error) {
+	bad := func(want string) error {
+		return fmt.Errorf("invalid value %q, expected %s", s, want)
+	}
+
+	switch fd.GetType() {
+	case descriptorpb.FieldDescriptorProto_TYPE_STRING:
+		return s, nil
+
+	case descriptorpb.FieldDescriptorProto_TYPE_BYTES:
+		for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+			if _, err := enc.DecodeString(s); err == nil {
+				return s, nil
+			}
+		}
+		return nil, bad("base64")
+
+	case descriptorpb.FieldDescriptorProto_TYPE_BOOL:
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, bad("true or false")
+		}
+		return v, nil
+
+	case descriptorpb.FieldDescriptorProto_TYPE_INT32, descriptorpb.FieldDescriptorProto_TYPE_SINT32,
+		descriptorpb.FieldDescriptorProto_TYPE_SFIXED32:
+		v, err := strconv.ParseInt(s, 10, 32)
+		if err != nil {
+			return nil, bad("a 32 bit integer")
+		}
+		return v, nil
+
+	case descriptorpb.FieldDescriptorProto_TYPE_UINT32, descriptorpb.FieldDescriptorProto_TYPE_FIXED32:
+		v, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return nil, bad("an unsigned 32 bit integer")
+		}
+		return v, nil
+
+	case descriptorpb.FieldDescriptorProto_TYPE_INT64, descriptorpb.FieldDescriptorProto_TYPE_SINT64,
+		descriptorpb.FieldDescriptorProto_TYPE_SFIXED64:
+		if _, err := strconv.ParseInt(s, 10, 64); err != nil {
+			return nil, bad("a 64 bit integer")
+		}
+		return s, nil
+
+	case descriptorpb.FieldDescriptorProto_TYPE_UINT64, descriptorpb.FieldDescriptorProto_TYPE_FIXED64:
+		if _, err := strconv.ParseUint(s, 10, 64); err != nil {
+			return nil, bad("an unsigned 64 bit integer")
+		}
+		return s, nil
+
+	case descriptorpb.FieldDescriptorProto_TYPE_FLOAT, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE:
+		bits := 64
+		if fd.GetType() == descriptorpb.FieldDescriptorProto_TYPE_FLOAT {
+			bits = 32
+		}
+		v, err := strconv.ParseFloat(s, bits)
+		if err != nil {
+			return nil, bad("a number")
+		}
+		// JSON has no literals for them, the mapping uses strings
+		switch {
+		case math.IsNaN(v):
+			return "NaN", nil
+		case math.IsInf(v, 1):
+			return "Infinity", nil
+		case math.IsInf(v, -1):
+			return "-Infinity", nil
+		}
+		return v, nil
+
+	case descriptorpb.FieldDescriptorProto_TYPE_ENUM:
+		ed := fd.GetEnumType()
+		if ed.FindValueByName(s) != nil {
+			return s, nil
+		}
+		if n, err := strconv.ParseInt(s, 10, 32); err == nil && ed.FindValueByNumber(int32(n)) != nil {
+			return n, nil
+		}
+		return nil, bad("one of " + strings.Join(enumNames(ed), ", "))
+
+	case descriptorpb.FieldDescriptorProto_TYPE_MESSAGE:
+		return wellKnownValue(fd.GetMessageType(), s)
+	}
+	return nil, fmt.Errorf("unsupported field type %s", fd.GetType())
+}
+
+func enumNames(ed *desc.EnumDescriptor) []string {
+	var names []string
+	for _, v := range ed.GetValues() {
+		names = append(names, v.GetName())
+	}
+	return names
+}
+
+// wellKnownValue converts s for the message types with a JSON form of a single
+// value: timestamps, durations, field masks and the wrappers.
+func wellKnownValue(md *desc.MessageDescriptor, s string) (interface{}, error) {
+	switch md.GetFullyQualifiedName() {
+	case "google.protobuf.Timestamp":
+		if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+			return nil, fmt.Errorf("invalid value %q, expected an RFC 3339 timestamp", s)
+		}
+		return s, nil
+	case "google.protobuf.Duration":
+		if _, err := strconv.ParseFloat(strings.TrimSuffix(s, "s"), 64); err != nil || !strings.HasSuffix(s, "s") {
+			return nil, fmt.Errorf("invalid value %q, expected seconds like 1.5s", s)
+		}
+		return s, nil
+	case "google.protobuf.FieldMask":
+		return s, nil
+	case "google.protobuf.DoubleValue", "google.protobuf.FloatValue", "google.protobuf.Int64Value",
+		"google.protobuf.UInt64Value", "google.protobuf.Int32Value", "google.protobuf.UInt32Value",
+		"google.protobuf.BoolValue", "google.protobuf.StringValue", "google.protobuf.BytesValue":
+		return fieldValue(md.FindFieldByName("value"), s)
+	}
+	return nil, fmt.Errorf("message %s can not be set from a single value, set its fields", md.GetFullyQualifiedName())
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/fullstorydev/grpcurl"
+	"github.com/jhump/protoreflect/desc"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func querySource(t *testing.T) grpcurl.DescriptorSource {
+	source, err := grpcurl.DescriptorSourceFromProtoFiles([]string{"testdata"}, "query.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return source
+}
+
+func queryMethod(t *testing.T) *desc.MethodDescriptor {
+	md, err := methodDescriptor(querySource(t), "query.Library/CreateBook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return md
+}
+
+func TestQueryToJSON(t *testing.T) {
+	input := queryMethod(t).GetInputType()
+
+	query, _ := url.ParseQuery("book.title=The%20Hobbit&book.shelf.floor=2&book.pages=310&book.tags=a&book.tags=b" +
+		"&book.price=9.5&book.available=true&book.published=1937-09-21T00:00:00Z&book.edition=3&view=FULL&ids=1&ids=2")
+	s, err := queryToJSON(`{"book":{"title":"kept"}}`, input, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]interface{}
+	json.Unmarshal([]byte(s), &got)
+	want := map[string]interface{}{
+		"book": map[string]interface{}{
+			"title": "kept", "shelf": map[string]interface{}{"floor": 2.0}, "pages": "310", "tags": []interface{}{"a", "b"},
+			"price": 9.5, "available": true, "published": "1937-09-21T00:00:00Z", "edition": 3.0,
+		},
+		"view": "FULL",
+		"ids":  []interface{}{1.0, 2.0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %s", want, s)
+	}
+
+	// beyond the 53 bits of a float64
+	query, _ = url.ParseQuery("view=FULL")
+	if s, err := queryToJSON(`{"book":{"pages":9007199254740993}}`, input, query); err != nil || !strings.Contains(s, `"pages":9007199254740993`) {
+		t.Errorf("expected the int64 of the body to be kept, got %s %v", s, err)
+	}
+
+	errs := map[string]string{
+		"book.author=x":             `unknown field "book.author"`,
+		"book.title.x=y":            `field "book.title" is not a message`,
+		"book.pages=many":           `field "book.pages": invalid value "many", expected a 64 bit integer`,
+		"book.available=maybe":      `expected true or false`,
+		"view=NONE":                 `expected one of BASIC, FULL`,
+		"book.published=today":      `expected an RFC 3339 timestamp`,
+		"book.title=a&book.title=b": `field "book.title" is not repeated but has 2 values`,
+		"book.labels=x":             `map field "book.labels"`,
+	}
+	for raw, msg := range errs {
+		query, _ := url.ParseQuery(raw)
+		if _, err := queryToJSON("", input, query); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%s: expected an error with %s, got %v", raw, msg, err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fullstorydev/grpcurl"
+	"github.com/golang/protobuf/jsonpb"
+	protov1 "github.com/golang/protobuf/proto"
+	_ "google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"net/http"
+	"strings"
+)
+
+// httpStatusFromGrpc maps gRPC codes to HTTP statuses the way grpc-gateway and the
+// google.rpc.Code documentation do.
+func httpStatusFromGrpc(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499 // client closed request
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	// Unknown, Internal, DataLoss
+	return http.StatusInternalServerError
+}
+
+// callErrorStatus tells which invocation errors are the caller's fault rather than a
+// failure to reach the upstream: a method the upstream does not have or a request
+// body which does not fit the request message.
+func callErrorStatus(err error) (*status.Status, bool) {
+	msg := err.Error()
+	switch {
+	case isUnknownMethod(err):
+		return status.New(codes.Unimplemented, msg), true
+	case strings.Contains(msg, "request data"):
+		return status.New(codes.InvalidArgument, msg), true
+	}
+	return nil, false
+}
+
+// detailResolver finds the message types of status details, the well known
+// google.rpc ones first and then the ones of the upstream.
+type detailResolver struct {
+	upstream jsonpb.AnyResolver
+}
+
+func (r detailResolver) Resolve(typeURL string) (protov1.Message, error) {
+	if mt, err := protoregistry.GlobalTypes.FindMessageByURL(typeURL); err == nil {
+		return protov1.MessageV1(mt.New().Interface()), nil
+	}
+	if r.upstream == nil {
+		return nil, fmt.Errorf("unknown message type %s", typeURL)
+	}
+	return r.upstream.Resolve(typeURL)
+}
+
+// grpcStatusJSON renders st like google.rpc.Status: code, message and the details
+// decoded.
+func grpcStatusJSON(st *status.Status, descSource grpcurl.DescriptorSource) string {
+	resolver := detailResolver{}
+	if descSource != nil {
+		resolver.upstream = grpcurl.AnyResolverFromDescriptorSourceWithFallback(descSource)
+	}
+	m := jsonpb.Marshaler{AnyResolver: resolver}
+
+	pb := st.Proto()
+	s, err := m.MarshalToString(pb)
+	if err != nil {
+		// better no details than no error
+		fmt.Println(err, "Failed to render status details")
+		pb.Details = nil
+		s, _ = m.MarshalToString(pb)
+	}
+
+	return s
+}
+
+// statusResponse answers r with st without calling the upstream.
+func statusResponse(r *http.Request, st *status.Status) *http.Response {
+	return grpcResponse(r, st, grpcStatusJSON(st, nil))
+}
+
+// grpcResponse answers a grpc call with the JSON response, or with the mapped status
+// and the error body when the upstream failed.
+func grpcResponse(r *http.Request, st *status.Status, body string) *http.Response {
+	if st.Code() != codes.OK {
+		if id := RequestID(r); id != "" {
+			fields := make(map[string]interface{})
+			if json.Unmarshal([]byte(body), &fields) == nil {
+				fields["request_id"] = id
+				data, _ := json.Marshal(fields)
+				body = string(data)
+			}
+		}
+	}
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+	return newResponse(r, httpStatusFromGrpc(st.Code()), header, []byte(body))
+}
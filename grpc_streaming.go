@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/fullstorydev/grpcurl"
+	"github.com/golang/protobuf/proto"
+	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const (
+	ndjsonContentType = "application/x-ndjson"
+	sseContentType    = "text/event-stream"
+)
+
+// acceptedMediaTypes returns the media types of the Accept headers of r.
+func acceptedMediaTypes(r *http.Request) []string {
+	var types []string
+	for _, v := range r.Header.Values("Accept") {
+		for _, t := range strings.Split(v, ",") {
+			if mt, _, err := mime.ParseMediaType(strings.TrimSpace(t)); err == nil {
+				types = append(types, mt)
+			}
+		}
+	}
+	return types
+}
+
+// streamContentType is how the responses of a server streaming call are written to
+// the client of r: SSE if it accepts it, NDJSON otherwise.
+func streamContentType(r *http.Request) string {
+	for _, t := range acceptedMediaTypes(r) {
+		if t == sseContentType {
+			return sseContentType
+		}
+	}
+	return ndjsonContentType
+}
+
+// isServerStream tells whether md sends a stream of responses for a single request.
+func isServerStream(md *desc.MethodDescriptor) bool {
+	return md.IsServerStreaming() && !md.IsClientStreaming()
+}
+
+// streamWriter is the event handler of a server streaming call, it writes every
+// response to the client as soon as it arrives. The events are "message" for the
+// responses and "trailers" for the status and trailers of the call, as SSE events or
+// NDJSON lines {"<event>": data}.
+type streamWriter struct {
+	w         *io.PipeWriter
+	sse       bool
+	formatter grpcurl.Formatter
+	// binding picks the response_body of transcoded calls, it may be nil.
+	binding *httpBinding
+	cancel  context.CancelFunc
+
+	// started is closed when the first headers or response arrive, the HTTP
+	// response is sent then.
+	started chan struct{}
+
+	header, trailer metadata.MD
+	status          *status.Status
+}
+
+func (s *streamWriter) start() {
+	select {
+	case <-s.started:
+	default:
+		close(s.started)
+	}
+}
+
+func (s *streamWriter) isStarted() bool {
+	select {
+	case <-s.started:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *streamWriter) OnResolveMethod(*desc.MethodDescriptor) {}
+
+func (s *streamWriter) OnSendHeaders(metadata.MD) {}
+
+func (s *streamWriter) OnReceiveHeaders(md metadata.MD) {
+	// grpc reports no headers for trailers-only responses, the call failed or sent
+	// nothing then
+	if md == nil {
+		return
+	}
+	s.header = md
+	s.start()
+}
+
+func (s *streamWriter) OnReceiveResponse(m proto.Message) {
+	s.start()
+	out, err := s.formatter(m)
+	if err != nil {
+		fmt.Println(err, "Failed to format streamed response")
+		s.cancel()
+		return
+	}
+	if s.binding != nil {
+		out = s.binding.responseJSON(out)
+	}
+	s.write("message", out)
+}
+
+func (s *streamWriter) OnReceiveTrailers(st *status.Status, md metadata.MD) {
+	s.status, s.trailer = st, md
+}
+
+// write sends one event, a failed write means the client is gone and ends the call.
+func (s *streamWriter) write(event, data string) {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, []byte(data)); err == nil {
+		data = compact.String()
+	}
+
+	var err error
+	if s.sse {
+		_, err = fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, data)
+	} else {
+		_, err = fmt.Fprintf(s.w, "{%q:%s}\n", event, data)
+	}
+	if err != nil {
+		s.cancel()
+	}
+}
+
+// writeTrailers sends the final event.
+func (s *streamWriter) writeTrailers(st *status.Status, descSource grpcurl.DescriptorSource) {
+	md, _ := json.Marshal(responseMetadata(s.trailer))
+	s.write("trailers", fmt.Sprintf(`{"status":%s,"metadata":%s}`, grpcStatusJSON(st, descSource), md))
+}
+
+// streamBody ends the call when the proxy stops reading, after the last event or when
+// the client went away.
+type streamBody struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+}
+
+func (b *streamBody) Close() error {
+	b.cancel()
+	return b.PipeReader.Close()
+}
+
+// streamRPC calls the server streaming method symbol and answers with its responses
+// as they come. Failures before the first response are answered like the ones of
+// unary calls.
+func (g *defaultGrpcTransport) streamRPC(req *http.Request, reqContent, target, symbol string, headers []string, descSource grpcurl.DescriptorSource, binding *httpBinding) (*http.Response, error) {
+	cc, release, err := g.pool.Get(target)
+	if err != nil {
+		fmt.Println(err, "Failed to dial target host", target)
+		observeGrpc(target, symbol, codes.Unavailable)
+		return nil, err
+	}
+	if descSource == nil {
+		descSource, _ = g.descriptors.get(target, cc)
+	}
+	rf, formatter, err := grpcurl.RequestParserAndFormatterFor(grpcurl.Format("json"), descSource, false, true, strings.NewReader(reqContent))
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	contentType := streamContentType(req)
+	ctx, cancel := context.WithCancel(req.Context())
+	pr, pw := io.Pipe()
+	s := &streamWriter{
+		w:         pw,
+		sse:       contentType == sseContentType,
+		formatter: formatter,
+		binding:   binding,
+		cancel:    cancel,
+		started:   make(chan struct{}),
+	}
+
+	// failed is where the call reports a failure nothing was streamed for, a nil
+	// status with the transport error.
+	type failure struct {
+		status *status.Status
+		err    error
+	}
+	failed := make(chan failure, 1)
+
+	go func() {
+		defer release()
+		err := grpcurl.InvokeRPC(ctx, descSource, cc, symbol, headers, s, rf.Next)
+
+		st := s.status
+		if st == nil {
+			// grpc reports OK as a nil status
+			st = status.New(codes.OK, "")
+		}
+		callErr := false
+		if err != nil {
+			if st, callErr = callErrorStatus(err); !callErr {
+				fmt.Println(err, "Error invoking method", symbol)
+				st = status.New(status.Code(err), err.Error())
+				if st.Code() == codes.OK {
+					st = status.New(codes.Unknown, err.Error())
+				}
+			}
+		}
+		observeGrpc(target, symbol, st.Code())
+
+		if !s.isStarted() {
+			if err != nil && !callErr {
+				failed <- failure{err: err}
+				return
+			}
+			if st.Code() != codes.OK {
+				failed <- failure{status: st}
+				return
+			}
+			s.start()
+		}
+		s.writeTrailers(st, descSource)
+		pw.Close()
+	}()
+
+	select {
+	case <-s.started:
+		// the upstream answered, the stream lasts as long as it sends
+		liftTimeout(req)
+	case f := <-failed:
+		cancel()
+		if f.err != nil {
+			return nil, f.err
+		}
+		resp := grpcResponse(req, f.status, grpcStatusJSON(f.status, descSource))
+		g.mdRules.toHeader(resp.Header, s.header, s.trailer)
+		return resp, nil
+	}
+
+	header := make(http.Header)
+	header.Set("Content-Type", contentType)
+	header.Set("Cache-Control", "no-cache")
+	g.mdRules.toHeader(header, s.header, nil)
+	resp := newResponse(req, http.StatusOK, header, nil)
+	// an unknown length makes the proxy flush every write
+	resp.Body = &streamBody{PipeReader: pr, cancel: cancel}
+	resp.ContentLength = -1
+	return resp, nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// streamer is the mock streaming upstream, registered without generated code.
+type streamer struct {
+	// canceled gets the calls which ended because the gateway went away
+	canceled chan struct{}
+}
+
+var streamerDesc = grpc.ServiceDesc{
+	ServiceName: "streaming.Streamer",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{
+		{StreamName: "Count", ServerStreams: true, Handler: countHandler},
+		{StreamName: "Sum", ClientStreams: true, Handler: sumHandler},
+		{StreamName: "Echo", ServerStreams: true, ClientStreams: true, Handler: echoHandler},
+	},
+	Metadata: "streaming.proto",
+}
+
+// countHandler sends 1 to n. A negative n fails at once, 100 waits after the first
+// number until the call is cancelled, 101 fails after it and 102 waits without
+// sending anything.
+func countHandler(srv interface{}, stream grpc.ServerStream) error {
+	n := &wrapperspb.Int32Value{}
+	if err := stream.RecvMsg(n); err != nil {
+		return err
+	}
+	if n.Value < 0 {
+		return status.Error(codes.InvalidArgument, "negative count")
+	}
+	stream.SetHeader(metadata.Pairs("x-streamed", "yes"))
+	stream.SetTrailer(metadata.Pairs("x-count", strconv.Itoa(int(n.Value))))
+
+	switch n.Value {
+	case 100:
+		stream.SendMsg(wrapperspb.String("1"))
+		<-stream.Context().Done()
+		srv.(*streamer).canceled <- struct{}{}
+		return stream.Context().Err()
+	case 101:
+		stream.SendMsg(wrapperspb.String("1"))
+		return status.Error(codes.Aborted, "count aborted")
+	case 102:
+		<-stream.Context().Done()
+		srv.(*streamer).canceled <- struct{}{}
+		return stream.Context().Err()
+	}
+	for i := 1; i <= int(n.Value); i++ {
+		if err := stream.SendMsg(wrapperspb.String(strconv.Itoa(i))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sumHandler(srv interface{}, stream grpc.ServerStream) error {
+	sum := int32(0)
+	for {
+		n := &wrapperspb.Int32Value{}
+		if err := stream.RecvMsg(n); err == io.EOF {
+			return stream.SendMsg(wrapperspb.Int32(sum))
+		} else if err != nil {
+			return err
+		}
+		sum += n.Value
+	}
+}
+
+// echoHandler sends the requests back until it gets "fail".
+func echoHandler(srv interface{}, stream grpc.ServerStream) error {
+	for {
+		s := &wrapperspb.StringValue{}
+		if err := stream.RecvMsg(s); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if s.Value == "fail" {
+			return status.Error(codes.FailedPrecondition, "echo failed")
+		}
+		if err := stream.SendMsg(s); err != nil {
+			return err
+		}
+	}
+}
+
+func startStreamingUpstream(t *testing.T) (string, *streamer, *Upstream) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &streamer{canceled: make(chan struct{}, 1)}
+	s := grpc.NewServer()
+	s.RegisterService(&streamerDesc, srv)
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+
+	u := &Upstream{Host: l.Addr().String(), Schema: "grpc", GrpcEndPoint: "streaming.Streamer/Count",
+		ProtoFiles: []string{"streaming.proto"}, ImportPaths: []string{"testdata"}}
+	if err := u.loadDescriptors(); err != nil {
+		t.Fatal(err)
+	}
+	return l.Addr().String(), srv, u
+}
+
+func countRequest(u *Upstream, n int, accept string) *http.Request {
+	r := grpcRequest(u.Host, strconv.Itoa(n))
+	r.Method = u.GrpcEndPoint
+	r.Header.Set("Accept", accept)
+	return r.WithContext(context.WithValue(context.Background(), requestContextKey{}, &requestContext{upstream: u}))
+}
+
+func TestServerStreaming(t *testing.T) {
+	_, _, u := startStreamingUpstream(t)
+	g := NewDefaultGrpcTransport(nil)
+	defer g.(io.Closer).Close()
+
+	resp, err := g.RoundTrip(countRequest(u, 3, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if resp.Header.Get("Content-Type") != ndjsonContentType || resp.Header.Get("Grpc-Metadata-X-Streamed") != "yes" || len(lines) != 4 {
+		t.Fatalf("expected 3 messages and the trailers as NDJSON, got %v %s", resp.Header, data)
+	}
+	for i, line := range lines[:3] {
+		if line != `{"message":"`+strconv.Itoa(i+1)+`"}` {
+			t.Errorf("expected message %d, got %s", i+1, line)
+		}
+	}
+	var final struct {
+		Trailers struct {
+			Status   struct{ Code int }
+			Metadata map[string][]string
+		}
+	}
+	if err := json.Unmarshal([]byte(lines[3]), &final); err != nil || final.Trailers.Status.Code != 0 || final.Trailers.Metadata["x-count"][0] != "3" {
+		t.Errorf("expected OK trailers with x-count, got %s", lines[3])
+	}
+
+	resp, _ = g.RoundTrip(countRequest(u, 101, "text/event-stream"))
+	data, _ = ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != sseContentType ||
+		!strings.HasPrefix(string(data), "event: message\ndata: \"1\"\n\nevent: trailers\ndata: {\"status\":{\"code\":10,") {
+		t.Errorf("expected a message and the aborted status as SSE events, got %d %s", resp.StatusCode, data)
+	}
+
+	resp, _ = g.RoundTrip(countRequest(u, 0, ""))
+	if data, _ = ioutil.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || !strings.HasPrefix(string(data), `{"trailers":`) {
+		t.Errorf("expected an empty stream to send its trailers, got %d %s", resp.StatusCode, data)
+	}
+
+	// nothing was streamed yet, the failure is answered like a unary one
+	resp, _ = g.RoundTrip(countRequest(u, -1, ""))
+	if data, _ = ioutil.ReadAll(resp.Body); resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(data), "negative count") {
+		t.Errorf("expected INVALID_ARGUMENT as 400, got %d %s", resp.StatusCode, data)
+	}
+}
+
+func TestServerStreamingProxy(t *testing.T) {
+	_, srv, u := startStreamingUpstream(t)
+	g := NewDefaultGrpcTransport(nil)
+	defer g.(io.Closer).Close()
+
+	defer currentRoutes.Store(loadRoutes())
+	setRoutes([]RouteSpec{{Name: "count", Path: "^/count", Upstreams: []Upstream{*u}}})
+
+	server := &Server{grpcTransport: g}
+	proxy := &httputil.ReverseProxy{Director: server.Director, Transport: server}
+	// a stream outlives the timeout of the gateway
+	gateway := httptest.NewServer(withRequestContext(NewTimeoutHandler(proxy, 100*time.Millisecond, "gateway timeout")))
+	defer gateway.Close()
+
+	req, _ := http.NewRequest("POST", gateway.URL+"/count", strings.NewReader("100"))
+	req.Header.Set("Accept", "application/x-ndjson")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the upstream waits after the first message, it arrives without the rest
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != "{\"message\":\"1\"}\n" {
+		t.Fatalf("expected the first message to be flushed, got %q %v", line, err)
+	}
+	select {
+	case <-srv.canceled:
+		t.Fatal("expected the stream to last past the timeout")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	resp.Body.Close()
+	select {
+	case <-srv.canceled:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the client going away to cancel the call")
+	}
+}
+
+func TestServerStreamingTimeout(t *testing.T) {
+	_, srv, u := startStreamingUpstream(t)
+	g := NewDefaultGrpcTransport(nil)
+	defer g.(io.Closer).Close()
+
+	defer currentRoutes.Store(loadRoutes())
+	setRoutes([]RouteSpec{{Name: "count", Path: "^/count", Upstreams: []Upstream{*u}}})
+
+	server := &Server{grpcTransport: g}
+	proxy := &httputil.ReverseProxy{Director: server.Director, Transport: server}
+	gateway := httptest.NewServer(withRequestContext(NewTimeoutHandler(proxy, 100*time.Millisecond, "gateway timeout")))
+	defer gateway.Close()
+
+	// the timeout is only lifted once the stream started
+	resp, err := http.Post(gateway.URL+"/count", "application/json", strings.NewReader("102"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("expected a stream which never started to time out, got %d", resp.StatusCode)
+	}
+	select {
+	case <-srv.canceled:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the timeout to cancel the call")
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/fullstorydev/grpcurl"
+	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	protov2 "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// transcoder maps HTTP requests to the gRPC methods annotated with google.api.http,
+// every annotated method of the upstream is reachable without configuring it.
+type transcoder struct {
+	source   grpcurl.DescriptorSource
+	bindings []*httpBinding
+}
+
+// httpBinding is one HTTP rule of a method, its additional bindings are bindings too.
+type httpBinding struct {
+	method   string
+	template string
+	// pattern matches the escaped path, fields are the field paths of its groups.
+	pattern *regexp.Regexp
+	fields  []string
+
+	body         string
+	responseBody string
+
+	symbol string
+	md     *desc.MethodDescriptor
+}
+
+func newTranscoder(source grpcurl.DescriptorSource) (*transcoder, error) {
+	services, err := grpcurl.ListServices(source)
+	if err != nil {
+		return nil, fmt.Errorf("can not list services: %v", err)
+	}
+
+	t := &transcoder{source: source}
+	for _, name := range services {
+		d, err := source.FindSymbol(name)
+		if err != nil {
+			return nil, err
+		}
+		sd, ok := d.(*desc.ServiceDescriptor)
+		if !ok {
+			continue
+		}
+		for _, md := range sd.GetMethods() {
+			rule := httpRuleOf(md)
+			if rule == nil {
+				continue
+			}
+			for _, r := range append([]*annotations.HttpRule{rule}, rule.AdditionalBindings...) {
+				b, err := newHTTPBinding(r, md)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %v", md.GetFullyQualifiedName(), err)
+				}
+				t.bindings = append(t.bindings, b)
+			}
+		}
+	}
+	sortBindings(t.bindings)
+	return t, nil
+}
+
+// sortBindings orders bindings so that a path matched by several templates goes to
+// the most specific one, like /v1/messages/{id}:cancel rather than /v1/messages/{id}.
+func sortBindings(bindings []*httpBinding) {
+	sort.SliceStable(bindings, func(i, j int) bool {
+		return bindings[i].moreSpecific(bindings[j])
+	})
+}
+
+// httpRuleOf returns the google.api.http option of md, nil if it has none. Options
+// parsed without the annotations linked in keep the rule as unknown fields, they
+// are decoded again.
+func httpRuleOf(md *desc.MethodDescriptor) *annotations.HttpRule {
+	opts := md.GetMethodOptions()
+	if opts == nil {
+		return nil
+	}
+	data, err := protov2.Marshal(opts)
+	if err != nil {
+		return nil
+	}
+	decoded := &descriptorpb.MethodOptions{}
+	if err := (protov2.UnmarshalOptions{Resolver: protoregistry.GlobalTypes}).Unmarshal(data, decoded); err != nil {
+		return nil
+	}
+	rule, _ := protov2.GetExtension(decoded, annotations.E_Http).(*annotations.HttpRule)
+	if rule == nil || rule.Pattern == nil {
+		return nil
+	}
+	return rule
+}
+
+func newHTTPBinding(rule *annotations.HttpRule, md *desc.MethodDescriptor) (*httpBinding, error) {
+	b := &httpBinding{
+		body:         rule.Body,
+		responseBody: rule.ResponseBody,
+		symbol:       md.GetService().GetFullyQualifiedName() + "/" + md.GetName(),
+		md:           md,
+	}
+
+	var template string
+	switch p := rule.Pattern.(type) {
+	case *annotations.HttpRule_Get:
+		b.method, template = http.MethodGet, p.Get
+	case *annotations.HttpRule_Put:
+		b.method, template = http.MethodPut, p.Put
+	case *annotations.HttpRule_Post:
+		b.method, template = http.MethodPost, p.Post
+	case *annotations.HttpRule_Delete:
+		b.method, template = http.MethodDelete, p.Delete
+	case *annotations.HttpRule_Patch:
+		b.method, template = http.MethodPatch, p.Patch
+	case *annotations.HttpRule_Custom:
+		b.method, template = strings.ToUpper(p.Custom.Kind), p.Custom.Path
+	}
+
+	var err error
+	b.template = template
+	b.pattern, b.fields, err = compilePathTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.body != "" && b.body != "*" && md.GetInputType().FindFieldByName(b.body) == nil {
+		return nil, fmt.Errorf("body field %q not in %s", b.body, md.GetInputType().GetFullyQualifiedName())
+	}
+	if b.responseBody != "" && md.GetOutputType().FindFieldByName(b.responseBody) == nil {
+		return nil, fmt.Errorf("response_body field %q not in %s", b.responseBody, md.GetOutputType().GetFullyQualifiedName())
+	}
+	return b, nil
+}
+
+// compilePathTemplate turns a google.api.http path template into a regexp, with a
+// group per variable:
+//
+//	Template = "/" Segments [ Verb ] ;
+//	Segments = Segment { "/" Segment } ;
+//	Segment  = "*" | "**" | LITERAL | Variable ;
+//	Variable = "{" FieldPath [ "=" Segments ] "}" ;
+//	Verb     = ":" LITERAL ;
+func compilePathTemplate(template string) (*regexp.Regexp, []string, error) {
+	if !strings.HasPrefix(template, "/") {
+		return nil, nil, fmt.Errorf("path template %q must start with /", template)
+	}
+
+	var verb string
+	if i := strings.LastIndex(template, ":"); i > strings.LastIndex(template, "/") && i > strings.LastIndex(template, "}") {
+		template, verb = template[:i], template[i+1:]
+	}
+
+	var expr strings.Builder
+	var fields []string
+	rest := template[1:]
+	for rest != "" {
+		var segment string
+		if strings.HasPrefix(rest, "{") {
+			end := strings.Index(rest, "}")
+			if end < 0 {
+				return nil, nil, fmt.Errorf("unterminated variable in %q", template)
+			}
+			segment, rest = rest[:end+1], rest[end+1:]
+		} else if i := strings.Index(rest, "/"); i >= 0 {
+			segment, rest = rest[:i], rest[i:]
+		} else {
+			segment, rest = rest, ""
+		}
+		rest = strings.TrimPrefix(rest, "/")
+
+		expr.WriteString("/")
+		if strings.HasPrefix(segment, "{") {
+			variable := segment[1 : len(segment)-1]
+			field, sub := variable, "*"
+			if i := strings.Index(variable, "="); i >= 0 {
+				field, sub = variable[:i], variable[i+1:]
+			}
+			fields = append(fields, field)
+			expr.WriteString("(" + segmentsExpr(sub) + ")")
+		} else {
+			expr.WriteString(segmentsExpr(segment))
+		}
+	}
+	if verb != "" {
+		expr.WriteString(regexp.QuoteMeta(":" + verb))
+	}
+
+	reg, err := regexp.Compile("^" + expr.String() + "$")
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid path template %q: %v", template, err)
+	}
+	return reg, fields, nil
+}
+
+func segmentsExpr(segments string) string {
+	parts := strings.Split(segments, "/")
+	for i, part := range parts {
+		switch part {
+		case "*":
+			parts[i] = "[^/]+"
+		case "**":
+			parts[i] = ".*"
+		default:
+			parts[i] = regexp.QuoteMeta(part)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+var templateVariable = regexp.MustCompile(`\{[^=}]*=?|\}`)
+
+// literalSegments counts the literal segments of a path template and its verb, and
+// the ** segments which match any number of them.
+func literalSegments(template string) (literals, deep int) {
+	if i := strings.LastIndex(template, ":"); i > strings.LastIndex(template, "/") && i > strings.LastIndex(template, "}") {
+		template = template[:i]
+		literals++
+	}
+	for _, segment := range strings.Split(templateVariable.ReplaceAllString(template, ""), "/") {
+		switch segment {
+		case "", "*":
+		case "**":
+			deep++
+		default:
+			literals++
+		}
+	}
+	return literals, deep
+}
+
+// moreSpecific tells whether b has more literal segments than o, or as many and
+// fewer ** segments.
+func (b *httpBinding) moreSpecific(o *httpBinding) bool {
+	bl, bd := literalSegments(b.template)
+	ol, od := literalSegments(o.template)
+	if bl != ol {
+		return bl > ol
+	}
+	return bd < od
+}
+
+// String is how the admin API shows b.
+func (b *httpBinding) String() string {
+	return b.method + " " + b.template + " " + b.symbol
+}
+
+// match returns the binding of method and path with the values of its variables.
+// allowed lists the methods bound to path when none is bound to method.
+func (t *transcoder) match(method, path string) (*httpBinding, map[string]string, []string) {
+	var allowed []string
+	for _, b := range t.bindings {
+		m := b.pattern.FindStringSubmatch(path)
+		if m == nil {
+			continue
+		}
+		if b.method != method {
+			allowed = append(allowed, b.method)
+			continue
+		}
+
+		vars := make(map[string]string, len(b.fields))
+		for i, field := range b.fields {
+			v, err := url.PathUnescape(m[i+1])
+			if err != nil {
+				v = m[i+1]
+			}
+			vars[field] = v
+		}
+		return b, vars, nil
+	}
+	return nil, nil, allowed
+}
+
+// unmarshalNumbers unmarshals data into v keeping numbers as json.Number, a float64 would
+// round the 64 bit integers of the message.
+func unmarshalNumbers(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("invalid character after top-level value")
+	}
+	return nil
+}
+
+// requestJSON builds the request message of r: the body as the body field or the
+// whole message, then the path variables, then the query parameters for the fields
+// which are still unset.
+func (b *httpBinding) requestJSON(r *http.Request, vars map[string]string) (string, error) {
+	msg := make(map[string]interface{})
+	input := b.md.GetInputType()
+
+	if b.body != "" && r.Body != nil {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return "", err
+		}
+		if len(strings.TrimSpace(string(data))) > 0 {
+			var body interface{}
+			if err := unmarshalNumbers(data, &body); err != nil {
+				return "", fmt.Errorf("invalid request body: %v", err)
+			}
+			if b.body == "*" {
+				obj, ok := body.(map[string]interface{})
+				if !ok {
+					return "", fmt.Errorf("request body must be a JSON object")
+				}
+				msg = obj
+			} else {
+				msg[findField(input, b.body).GetJSONName()] = body
+			}
+		}
+	}
+
+	for field, v := range vars {
+		if err := setTypedField(msg, input, field, []string{v}, true); err != nil {
+			return "", err
+		}
+	}
+
+	if b.body != "*" && r.URL.RawQuery != "" {
+		query, err := url.ParseQuery(r.URL.RawQuery)
+		if err != nil {
+			return "", fmt.Errorf("invalid query: %v", err)
+		}
+		if err := setQueryFields(msg, input, query); err != nil {
+			return "", err
+		}
+	}
+
+	data, err := json.Marshal(msg)
+	return string(data), err
+}
+
+// responseJSON returns the response_body field of the response, the whole response
+// without one.
+func (b *httpBinding) responseJSON(body string) string {
+	if b.responseBody == "" {
+		return body
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(body), &fields); err != nil {
+		return body
+	}
+	// the formatter writes json names
+	f := b.md.GetOutputType().FindFieldByName(b.responseBody)
+	if v, ok := fields[f.GetJSONName()]; ok {
+		return string(v)
+	}
+	if v, ok := fields[b.responseBody]; ok {
+		return string(v)
+	}
+	return "null"
+}
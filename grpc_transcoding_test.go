@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompilePathTemplate(t *testing.T) {
+	cases := []struct {
+		template, path string
+		vars           []string
+	}{
+		{"/v1/shelves/{shelf}", "/v1/shelves/1", []string{"1"}},
+		{"/v1/shelves/{shelf}", "/v1/shelves/1/books", nil},
+		{"/v1/{name=shelves/*/books/*}", "/v1/shelves/1/books/2", []string{"shelves/1/books/2"}},
+		{"/v1/{book.shelf}/books/{book.id}:publish", "/v1/1/books/2:publish", []string{"1", "2"}},
+		{"/v1/files/{path=**}", "/v1/files/a/b/c.txt", []string{"a/b/c.txt"}},
+		{"/v1/*/ping", "/v1/anything/ping", []string{}},
+	}
+	for _, c := range cases {
+		reg, _, err := compilePathTemplate(c.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := reg.FindStringSubmatch(c.path)
+		if c.vars == nil {
+			if m != nil {
+				t.Errorf("expected %s not to match %s", c.template, c.path)
+			}
+			continue
+		}
+		if m == nil || !reflect.DeepEqual(m[1:], c.vars) {
+			t.Errorf("expected %s to bind %v in %s, got %v", c.template, c.vars, c.path, m)
+		}
+	}
+
+	if _, _, err := compilePathTemplate("v1/{unterminated"); err == nil {
+		t.Error("expected a template without leading / to fail")
+	}
+}
+
+func TestRequestJSON(t *testing.T) {
+	tc, err := newTranscoder(querySource(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("POST", "/v1/shelves/1/books?view=FULL&book.pages=12", strings.NewReader(`{"title":"Dune"}`))
+	b, vars, _ := tc.match("POST", r.URL.EscapedPath())
+	s, err := b.requestJSON(r, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]interface{}
+	json.Unmarshal([]byte(s), &got)
+	want := map[string]interface{}{
+		"book": map[string]interface{}{"title": "Dune", "shelf": map[string]interface{}{"name": "shelves/1"}, "pages": "12"},
+		"view": "FULL",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %s", want, s)
+	}
+
+	// beyond the 53 bits of a float64
+	r = httptest.NewRequest("POST", "/v1/shelves/1/books", strings.NewReader(`{"pages":9007199254740993}`))
+	if s, err := b.requestJSON(r, vars); err != nil || !strings.Contains(s, `"pages":9007199254740993`) {
+		t.Errorf("expected the int64 to be kept, got %s %v", s, err)
+	}
+
+	for _, body := range []string{`{"title":`, `{"title":"Dune"} {}`} {
+		r = httptest.NewRequest("POST", "/v1/shelves/1/books", strings.NewReader(body))
+		if _, err := b.requestJSON(r, vars); err == nil {
+			t.Errorf("expected the malformed body %s to fail", body)
+		}
+	}
+
+	r = httptest.NewRequest("POST", "/v1/shelves/1/books?view=none", nil)
+	if _, err := b.requestJSON(r, vars); err == nil {
+		t.Error("expected an unknown enum value to fail")
+	}
+}
+
+func TestTranscoding(t *testing.T) {
+	addr, _ := startGrpcUpstream(t, false)
+	g := NewDefaultGrpcTransport(nil)
+	defer g.(io.Closer).Close()
+
+	u := &Upstream{Host: addr, Schema: "grpc", Transcode: true, ProtoFiles: []string{"transcoding.proto"}, ImportPaths: []string{"testdata"}}
+	if err := u.loadDescriptors(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		method, path, body string
+		code               int
+		want               string
+	}{
+		{"GET", "/v1/hello/nihao", "", http.StatusOK, `"世界 nihao"`},
+		{"POST", "/v1/hello", `{"hello":"ni hao"}`, http.StatusOK, `"世界 ni hao"`},
+		{"GET", "/v1/world/greetings/hi", "", http.StatusOK, `"世界 greetings/hi"`},
+		{"GET", "/v1/hello/a%2Fb", "", http.StatusOK, `"世界 a/b"`},
+		{"GET", "/v1/hello/nobody", "", http.StatusNotFound, `"no such greeting"`},
+		{"DELETE", "/v1/hello/nihao", "", http.StatusMethodNotAllowed, ""},
+		{"GET", "/v2/hello", "", http.StatusNotFound, ""},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+		r.URL.Host = addr
+		r = r.WithContext(context.WithValue(r.Context(), requestContextKey{}, &requestContext{upstream: u}))
+
+		resp, err := g.RoundTrip(r)
+		if err != nil {
+			t.Fatalf("%s %s: %v", c.method, c.path, err)
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != c.code || !strings.Contains(string(data), c.want) {
+			t.Errorf("%s %s: expected %d with %s, got %d %s", c.method, c.path, c.code, c.want, resp.StatusCode, data)
+		}
+	}
+}
+
+func TestBindingSpecificity(t *testing.T) {
+	templates := []string{
+		"/v1/{name=**}",
+		"/v1/messages/{id}",
+		"/v1/messages/{id}:cancel",
+		"/v1/{parent=shelves/*}/messages",
+		"/v1/messages/latest",
+		"/v1/messages:batch",
+	}
+	tc := &transcoder{}
+	for _, template := range templates {
+		reg, fields, err := compilePathTemplate(template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.bindings = append(tc.bindings, &httpBinding{method: "GET", template: template, pattern: reg, fields: fields})
+	}
+	sortBindings(tc.bindings)
+
+	cases := []struct{ path, template string }{
+		{"/v1/messages/1", "/v1/messages/{id}"},
+		{"/v1/messages/1:cancel", "/v1/messages/{id}:cancel"},
+		{"/v1/messages/latest", "/v1/messages/latest"},
+		{"/v1/messages:batch", "/v1/messages:batch"},
+		{"/v1/shelves/1/messages", "/v1/{parent=shelves/*}/messages"},
+		{"/v1/shelves/1", "/v1/{name=**}"},
+	}
+	for _, c := range cases {
+		if b, _, _ := tc.match("GET", c.path); b == nil || b.template != c.template {
+			t.Errorf("%s: expected %s, got %v", c.path, c.template, b)
+		}
+	}
+}
+
+func TestTranscodeDirector(t *testing.T) {
+	defer currentRoutes.Store(loadRoutes())
+	setRoutes([]RouteSpec{{
+		Path:      "^/api/(.*)",
+		Upstreams: []Upstream{{Host: "localhost:9000", Schema: "grpc", Transcode: true}},
+	}})
+
+	for path, want := range map[string]string{
+		"/api/v1/hello/a%2Fb": "/v1/hello/a%2Fb",
+		"/api/v1/hello/a%20b": "/v1/hello/a%20b",
+		"/api/v1/hello/nihao": "/v1/hello/nihao",
+	} {
+		r := httptest.NewRequest("GET", path, nil)
+		(&Server{}).Director(r)
+		if got := r.URL.EscapedPath(); got != want {
+			t.Errorf("%s: expected %s upstream, got %s", path, want, got)
+		}
+	}
+}
+
+func TestReflectedBindings(t *testing.T) {
+	defer func(s *Server, t *routeTable) {
+		gatewayServer = s
+		currentRoutes.Store(t)
+	}(gatewayServer, loadRoutes())
+
+	addr, _ := startGrpcUpstream(t, true)
+	g := NewDefaultGrpcTransport(nil).(*defaultGrpcTransport)
+	defer g.Close()
+	gatewayServer = &Server{grpcTransport: g}
+
+	// the mock upstream is built without the annotations, its reflected transcoder
+	// is the one of the annotated file
+	static := &Upstream{Host: addr, Schema: "grpc", Transcode: true, ProtoFiles: []string{"transcoding.proto"}, ImportPaths: []string{"testdata"}}
+	if err := static.loadDescriptors(); err != nil {
+		t.Fatal(err)
+	}
+	cc, release, err := g.pool.Get(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, _ := g.descriptors.entry(addr, cc)
+	release()
+	e.transcoderOnce.Do(func() { e.transcoder = static.transcoder })
+
+	reflected := Upstream{Host: addr, Schema: "grpc", Transcode: true}
+	setRoutes([]RouteSpec{{Name: "hello", Path: "^/api/(.*)", Upstreams: []Upstream{reflected, reflected}}})
+
+	infos := compiledRoutes()
+	want := []string{
+		"GET /v1/world/{hello=greetings/*} proto.GrpcUpstreamService/Hello",
+		"GET /v1/hello/{hello} proto.GrpcUpstreamService/Hello",
+		"POST /v1/hello proto.GrpcUpstreamService/Hello",
+	}
+	if len(infos) != 1 || infos[0].Error != "" || !reflect.DeepEqual(infos[0].Bindings, want) {
+		t.Errorf("expected one binding per HTTP rule, got %+v", infos)
+	}
+}
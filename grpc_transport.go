@@ -3,159 +3,313 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/fullstorydev/grpcurl"
-	"github.com/jhump/protoreflect/grpcreflect"
+	"github.com/jhump/protoreflect/desc"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
-	reflectpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
 	"io/ioutil"
 	"net/http"
-	"os"
+	"net/url"
 	"strings"
+	"time"
 )
 
 type GrpcTransport interface {
 	RoundTrip(*http.Request) (*http.Response, error)
 }
 
-// TODO we should use connection pool to improve performance, but you know, its a prototype project now.
 type defaultGrpcTransport struct {
-	conns map[string]*grpc.ClientConn
-	// TODO add rwmutex for conns
+	pool        *grpcConnPool
+	descriptors *descriptorCache
+	mdRules     *metadataRules
 }
 
-func NewDefaultGrpcTransport() GrpcTransport {
+// NewDefaultGrpcTransport calls upstreams over pooled connections, cfg may be nil.
+func NewDefaultGrpcTransport(cfg *GrpcPoolConfig) GrpcTransport {
+	pool := newGrpcConnPool(cfg)
+	go pool.Run()
 	return &defaultGrpcTransport{
-		conns: make(map[string]*grpc.ClientConn),
+		pool:        pool,
+		descriptors: newDescriptorCache(time.Duration(pool.cfg.DescriptorTTL)),
+		mdRules:     newMetadataRules(pool.cfg.Metadata),
 	}
 }
 
+func (g *defaultGrpcTransport) Close() error {
+	g.descriptors.flush()
+	g.pool.Close()
+	return nil
+}
+
+// RefreshDescriptors makes the next call to each upstream reflect again.
+func (g *defaultGrpcTransport) RefreshDescriptors() {
+	g.descriptors.flush()
+}
+
 func (g *defaultGrpcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	if req.URL.RawQuery != "" {
-		str, err := g.transformRawQueryToBodyJson(req.URL.RawQuery)
+	if u := getRequestContext(req).upstream; u != nil && u.Transcode {
+		return g.transcode(req, u)
+	}
+
+	// the proxy drops empty bodies
+	var reqContent string
+	if req.Body != nil {
+		reqBytes, err := ioutil.ReadAll(req.Body)
 		if err != nil {
 			return nil, err
 		}
-		req.Body = ioutil.NopCloser(bytes.NewBufferString(str))
+		reqContent = string(reqBytes)
+	}
+
+	target := req.URL.Host
+	symbol := req.Method
+
+	headers := g.requestMetadata(req)
+
+	var descSource grpcurl.DescriptorSource
+	if u := getRequestContext(req).upstream; u != nil {
+		descSource = u.descriptors
 	}
 
-	reqBytes, err := ioutil.ReadAll(req.Body)
+	md, err := g.findMethod(target, symbol, descSource)
 	if err != nil {
+		if st, ok := callErrorStatus(err); ok {
+			return statusResponse(req, st), nil
+		}
 		return nil, err
 	}
-	reqContent := string(reqBytes)
 
-	target := req.URL.Host
-	symbol := req.Method
+	if md.IsClientStreaming() && isWebSocket(req) {
+		return g.websocketRPC(req, target, symbol, headers, descSource)
+	}
 
-	respStr, err := g.invokeRPC(reqContent, target, symbol)
-	resp := &http.Response{}
-	if err != nil {
-		resp.StatusCode = http.StatusInternalServerError
-	} else {
-		resp.StatusCode = http.StatusOK
+	if req.URL.RawQuery != "" {
+		query, err := url.ParseQuery(req.URL.RawQuery)
+		if err != nil {
+			return statusResponse(req, status.New(codes.InvalidArgument, "invalid query: "+err.Error())), nil
+		}
+		if reqContent, err = queryToJSON(reqContent, md.GetInputType(), query); err != nil {
+			return statusResponse(req, status.New(codes.InvalidArgument, err.Error())), nil
+		}
+	}
+
+	if isServerStream(md) {
+		return g.streamRPC(req, reqContent, target, symbol, headers, descSource, nil)
 	}
-	resp.Body = ioutil.NopCloser(bytes.NewBufferString(respStr))
 
+	res, err := g.invokeRPC(req.Context(), reqContent, target, symbol, headers, descSource)
+	if err != nil {
+		// like the http transport, the proxy answers 502
+		return nil, err
+	}
+	resp := grpcResponse(req, res.status, res.body)
+	g.mdRules.toHeader(resp.Header, res.header, res.trailer)
 	return resp, nil
 }
 
-func (g *defaultGrpcTransport) transformRawQueryToBodyJson(rq string) (string, error) {
-	// TODO this is a simplest transformer, we'd better build a enhanced one.
-	m := make(map[string]string)
+// transcoder returns the bindings of the annotated methods target reflects.
+func (g *defaultGrpcTransport) transcoder(target string) (*transcoder, error) {
+	cc, release, err := g.pool.Get(target)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return g.descriptors.transcoder(target, cc)
+}
 
-	kvs := strings.Split(rq, "&")
+// transcode calls the method bound to the method and path of req.
+func (g *defaultGrpcTransport) transcode(req *http.Request, u *Upstream) (*http.Response, error) {
+	target := req.URL.Host
 
-	for _, kv := range kvs {
-		kvc := strings.Split(kv, "=")
-		k := kvc[0]
-		v := kvc[1]
+	tc := u.transcoder
+	if tc == nil {
+		var err error
+		if tc, err = g.transcoder(target); err != nil {
+			return nil, err
+		}
+	}
 
-		m[k] = v
+	binding, vars, allowed := tc.match(req.Method, req.URL.EscapedPath())
+	if binding == nil {
+		if len(allowed) > 0 {
+			return (&Abort{
+				StatusCode: http.StatusMethodNotAllowed,
+				Message:    "method not allowed",
+				Header:     http.Header{"Allow": []string{strings.Join(allowed, ", ")}},
+			}).response(req), nil
+		}
+		return (&Abort{StatusCode: http.StatusNotFound, Message: "no grpc method bound to " + req.URL.Path}).response(req), nil
 	}
 
-	ret, err := json.Marshal(m)
+	reqContent, err := binding.requestJSON(req, vars)
 	if err != nil {
-		return "", err
+		return statusResponse(req, status.New(codes.InvalidArgument, err.Error())), nil
+	}
+
+	if isServerStream(binding.md) {
+		return g.streamRPC(req, reqContent, target, binding.symbol, g.requestMetadata(req), tc.source, binding)
 	}
 
-	return string(ret), nil
+	res, err := g.invokeRPC(req.Context(), reqContent, target, binding.symbol, g.requestMetadata(req), tc.source)
+	if err != nil {
+		return nil, err
+	}
+	if res.status.Code() == codes.OK {
+		res.body = binding.responseJSON(res.body)
+	}
+	resp := grpcResponse(req, res.status, res.body)
+	g.mdRules.toHeader(resp.Header, res.header, res.trailer)
+	return resp, nil
 }
 
-func (g *defaultGrpcTransport) invokeRPC(reqContent, target, symbol string) (string, error) {
-	ctx := context.Background()
+// requestMetadata returns the metadata sent with the call of req, "name: value".
+func (g *defaultGrpcTransport) requestMetadata(req *http.Request) []string {
+	md := g.mdRules.fromHeader(req.Header)
+	for k, v := range traceMetadata(req.Context()) {
+		md[k] = v
+	}
+	if id := RequestID(req); id != "" {
+		md.Set("x-request-id", id)
+	}
+	return headerLines(md)
+}
 
-	dial := func() *grpc.ClientConn {
-		network := "tcp"
-		cc, err := grpcurl.BlockingDial(ctx, network, target, nil)
-		if err != nil {
-			fmt.Println(err, "Failed to dial target host %q", target)
+// findMethod returns the method descriptor of symbol, reflecting again once if the
+// cached descriptors do not know it.
+func (g *defaultGrpcTransport) findMethod(target, symbol string, descSource grpcurl.DescriptorSource) (*desc.MethodDescriptor, error) {
+	if descSource != nil {
+		return methodDescriptor(descSource, symbol)
+	}
+
+	cc, release, err := g.pool.Get(target)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	descSource, cached := g.descriptors.get(target, cc)
+	md, err := methodDescriptor(descSource, symbol)
+	if cached && isUnknownMethod(err) {
+		g.descriptors.invalidate(target)
+		descSource, _ = g.descriptors.get(target, cc)
+		md, err = methodDescriptor(descSource, symbol)
+	}
+	return md, err
+}
+
+// methodDescriptor finds symbol, "package.Service/Method" or "package.Service.Method".
+// Its errors read like the ones of grpcurl.InvokeRPC.
+func methodDescriptor(descSource grpcurl.DescriptorSource, symbol string) (*desc.MethodDescriptor, error) {
+	i := strings.LastIndex(symbol, "/")
+	if i < 0 {
+		i = strings.LastIndex(symbol, ".")
+	}
+	if i < 0 {
+		return nil, fmt.Errorf("service %q does not include a method named %q", "", symbol)
+	}
+	svc, method := symbol[:i], symbol[i+1:]
+
+	d, err := descSource.FindSymbol(svc)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil, fmt.Errorf("target server does not expose service %q", svc)
 		}
-		return cc
+		return nil, fmt.Errorf("failed to query for service descriptor %q: %v", svc, err)
 	}
+	sd, ok := d.(*desc.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("target server does not expose service %q", svc)
+	}
+	md := sd.FindMethodByName(method)
+	if md == nil {
+		return nil, fmt.Errorf("service %q does not include a method named %q", svc, method)
+	}
+	return md, nil
+}
 
-	var cc *grpc.ClientConn
-	var descSource grpcurl.DescriptorSource
-	var refClient *grpcreflect.Client
-
-	md := grpcurl.MetadataFromHeaders([]string{})
-	refCtx := metadata.NewOutgoingContext(ctx, md)
-
-	if conn, ok := g.conns[target]; !ok {
-		cc = dial()
-		g.conns[target] = cc
-	} else {
-		cc = conn
-	}
-
-	refClient = grpcreflect.NewClient(refCtx, reflectpb.NewServerReflectionClient(cc))
-	// TODO we might cache descSource periodically to improve performance
-	descSource = grpcurl.DescriptorSourceFromServer(ctx, refClient)
-
-	// arrange for the RPCs to be cleanly shutdown
-	//reset := func() {
-	//if refClient != nil {
-	//	refClient.Reset()
-	//	refClient = nil
-	//}
-	//if cc != nil {
-	//cc.Close()
-	//cc = nil
-	//}
-	//}
-	//defer reset()
-
-	exit := func(code int) {
-		// since defers aren't run by os.Exit...
-		//reset()
-		os.Exit(code)
-	}
-
-	// Invoke an RPC
-	in := strings.NewReader(reqContent)
+// grpcResult is what an upstream answered a call with.
+type grpcResult struct {
+	// body is the response, or the status rendered as JSON when it is not OK.
+	body    string
+	status  *status.Status
+	header  metadata.MD
+	trailer metadata.MD
+}
 
-	rf, formatter, err := grpcurl.RequestParserAndFormatterFor(grpcurl.Format("json"), descSource, false, true, in)
+// invokeRPC calls symbol on target with the descriptors of descSource or, when it is
+// nil, the ones the upstream reflects. err is only set when the upstream could not be
+// called.
+func (g *defaultGrpcTransport) invokeRPC(ctx context.Context, reqContent, target, symbol string, headers []string, descSource grpcurl.DescriptorSource) (*grpcResult, error) {
+	cc, release, err := g.pool.Get(target)
 	if err != nil {
-		fmt.Println(err, "Failed to construct request parser and formatter for %q", "json")
+		fmt.Println(err, "Failed to dial target host", target)
+		observeGrpc(target, symbol, codes.Unavailable)
+		return nil, err
 	}
+	defer release()
 
-	out := &bytes.Buffer{}
-	h := grpcurl.NewDefaultEventHandler(out, descSource, formatter, false)
+	cached := false
+	if descSource == nil {
+		descSource, cached = g.descriptors.get(target, cc)
+	}
+	res, err := g.invoke(ctx, descSource, cc, reqContent, symbol, headers)
+	if cached && isUnknownMethod(err) {
+		// the upstream may have been deployed with new services since we reflected
+		g.descriptors.invalidate(target)
+		descSource, _ = g.descriptors.get(target, cc)
+		res, err = g.invoke(ctx, descSource, cc, reqContent, symbol, headers)
+	}
 
-	err = grpcurl.InvokeRPC(ctx, descSource, cc, symbol, []string{}, h, rf.Next)
 	if err != nil {
-		fmt.Println(err, "Error invoking method %q", symbol)
+		var ok bool
+		if res.status, ok = callErrorStatus(err); !ok {
+			fmt.Println(err, "Error invoking method", symbol)
+			code := status.Code(err)
+			if code == codes.OK {
+				code = codes.Unknown
+			}
+			observeGrpc(target, symbol, code)
+			return nil, err
+		}
 	}
+	observeGrpc(target, symbol, res.status.Code())
 
-	if h.Status.Code() != codes.OK {
-		return "", errors.New("upstream return !OK")
-		exit(1)
+	if res.status.Code() != codes.OK {
+		res.body = grpcStatusJSON(res.status, descSource)
 	}
+	return res, nil
+}
+
+// metadataRecorder keeps the response metadata grpcurl hands to the event handler.
+type metadataRecorder struct {
+	*grpcurl.DefaultEventHandler
+	header, trailer metadata.MD
+}
 
-	return out.String(), nil
+func (h *metadataRecorder) OnReceiveHeaders(md metadata.MD) {
+	h.header = md
+	h.DefaultEventHandler.OnReceiveHeaders(md)
+}
+
+func (h *metadataRecorder) OnReceiveTrailers(st *status.Status, md metadata.MD) {
+	h.trailer = md
+	h.DefaultEventHandler.OnReceiveTrailers(st, md)
+}
+
+// invoke makes the call, the result is never nil.
+func (g *defaultGrpcTransport) invoke(ctx context.Context, descSource grpcurl.DescriptorSource, cc *grpc.ClientConn, reqContent, symbol string, headers []string) (*grpcResult, error) {
+	in := strings.NewReader(reqContent)
+
+	out := &bytes.Buffer{}
+	rf, formatter, err := grpcurl.RequestParserAndFormatterFor(grpcurl.Format("json"), descSource, false, true, in)
+	if err != nil {
+		return &grpcResult{}, err
+	}
+	h := &metadataRecorder{DefaultEventHandler: grpcurl.NewDefaultEventHandler(out, descSource, formatter, false)}
 
+	err = grpcurl.InvokeRPC(ctx, descSource, cc, symbol, headers, h, rf.Next)
+	return &grpcResult{body: out.String(), status: h.Status, header: h.header, trailer: h.trailer}, err
 }
@@ -1,21 +1,312 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"github.com/xumc/mini-gateway/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	protov2 "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
 )
 
+type helloServer struct{}
+
+func (helloServer) Hello(ctx context.Context, req *proto.Request) (*proto.Reply, error) {
+	switch req.Hello {
+	case "metadata":
+		// answers with the metadata received, and some to send back
+		md, _ := metadata.FromIncomingContext(ctx)
+		var keys []string
+		for k := range md {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		grpc.SetHeader(ctx, metadata.Pairs("x-served-by", "hello"))
+		grpc.SetTrailer(ctx, metadata.Pairs("x-cost", "1"))
+		return &proto.Reply{World: strings.Join(keys, ",")}, nil
+	case "unimplemented":
+		return nil, status.Error(codes.Unimplemented, "greeting not implemented")
+	case "nobody":
+		st, _ := status.New(codes.NotFound, "no such greeting").
+			WithDetails(&errdetails.ResourceInfo{ResourceType: "greeting", ResourceName: req.Hello})
+		return nil, st.Err()
+	}
+	return &proto.Reply{World: "世界 " + req.Hello}, nil
+}
+
+// startGrpcUpstream serves the mock upstream service, with reflection if reflect is
+// set. reflections counts the reflection streams opened.
+func startGrpcUpstream(tb testing.TB, reflect bool) (addr string, reflections *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	reflections = new(int32)
+	s := grpc.NewServer(grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if strings.Contains(info.FullMethod, "ServerReflection") {
+			atomic.AddInt32(reflections, 1)
+		}
+		return handler(srv, ss)
+	}))
+	proto.RegisterGrpcUpstreamServiceServer(s, helloServer{})
+	if reflect {
+		reflection.Register(s)
+	}
+
+	go s.Serve(l)
+	tb.Cleanup(s.Stop)
+	return l.Addr().String(), reflections
+}
+
 func TestInvokeRPC(t *testing.T) {
-	//g := NewDefaultGrpcTransport()
-	//content := "{\"hello\":\"nihao\"}"
-	//g.invokeRPC(content, "localhost:8081", "proto.GrpcUpstreamService/Hello")
+	addr, reflections := startGrpcUpstream(t, true)
+	g := NewDefaultGrpcTransport(nil).(*defaultGrpcTransport)
+	defer g.Close()
+
+	for i := 0; i < 3; i++ {
+		res, err := g.invokeRPC(context.Background(), `{"hello":"nihao"}`, addr, "proto.GrpcUpstreamService/Hello", nil, nil)
+		if err != nil || !strings.Contains(res.body, "世界 nihao") {
+			t.Fatalf("expected the reply, got %v %v", res, err)
+		}
+	}
+	if n := atomic.LoadInt32(reflections); n != 1 {
+		t.Errorf("expected the descriptors to be reflected once, got %d streams", n)
+	}
+
+	// an unknown method may be a new one, the descriptors are fetched again
+	if res, err := g.invokeRPC(context.Background(), `{}`, addr, "proto.GrpcUpstreamService/Bye", nil, nil); err != nil || res.status.Code() != codes.Unimplemented {
+		t.Errorf("expected an unknown method to be unimplemented, got %v %v", res, err)
+	}
+	if n := atomic.LoadInt32(reflections); n != 2 {
+		t.Errorf("expected an unknown method to reflect again, got %d streams", n)
+	}
+
+	// the method itself answering UNIMPLEMENTED ran, it is not called again
+	if res, err := g.invokeRPC(context.Background(), `{"hello":"unimplemented"}`, addr, "proto.GrpcUpstreamService/Hello", nil, nil); err != nil || res.status.Code() != codes.Unimplemented {
+		t.Errorf("expected the method's status, got %v %v", res, err)
+	}
+	if n := atomic.LoadInt32(reflections); n != 2 {
+		t.Errorf("expected a status of the method not to reflect again, got %d streams", n)
+	}
+
+	g.RefreshDescriptors()
+	if _, err := g.invokeRPC(context.Background(), `{"hello":"nihao"}`, addr, "proto.GrpcUpstreamService/Hello", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(reflections); n != 3 {
+		t.Errorf("expected a refresh to reflect again, got %d streams", n)
+	}
+}
+
+func TestInvokeRPCStaticDescriptors(t *testing.T) {
+	addr, _ := startGrpcUpstream(t, false)
+	g := NewDefaultGrpcTransport(nil).(*defaultGrpcTransport)
+	defer g.Close()
+
+	// a protoset like protoc --descriptor_set_out writes
+	fd, err := protoregistry.GlobalFiles.FindFileByPath("mock_upstream_grpc_service.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := protov2.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{protodesc.ToFileDescriptorProto(fd)}})
+	protoset := filepath.Join(t.TempDir(), "service.protoset")
+	if err := ioutil.WriteFile(protoset, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	upstreams := []Upstream{
+		{Host: addr, Schema: "grpc", Protosets: []string{protoset}},
+		{Host: addr, Schema: "grpc", ProtoFiles: []string{"mock_upstream_grpc_service.proto"}, ImportPaths: []string{"proto"}},
+	}
+	for _, u := range upstreams {
+		if err := u.loadDescriptors(); err != nil {
+			t.Fatal(err)
+		}
+		res, err := g.invokeRPC(context.Background(), `{"hello":"nihao"}`, addr, "proto.GrpcUpstreamService/Hello", nil, u.descriptors)
+		if err != nil || !strings.Contains(res.body, "世界 nihao") {
+			t.Errorf("expected the reply without reflection, got %v %v", res, err)
+		}
+	}
+
+	missing := Upstream{Host: addr, Schema: "grpc", ProtoFiles: []string{"missing.proto"}}
+	if err := missing.loadDescriptors(); err == nil {
+		t.Error("expected a missing proto file to fail")
+	}
+}
+
+func grpcRequest(addr, body string) *http.Request {
+	return &http.Request{
+		Method: "proto.GrpcUpstreamService/Hello",
+		URL:    &url.URL{Scheme: "grpc", Host: addr},
+		Header: make(http.Header),
+		Body:   ioutil.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func TestGrpcErrorResponse(t *testing.T) {
+	addr, _ := startGrpcUpstream(t, true)
+	g := NewDefaultGrpcTransport(nil)
+	defer g.(io.Closer).Close()
+
+	resp, err := g.RoundTrip(grpcRequest(addr, `{"hello":"nobody"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		Code    int
+		Message string
+		Details []map[string]interface{}
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	json.Unmarshal(data, &body)
+	if resp.StatusCode != http.StatusNotFound || body.Code != int(codes.NotFound) || body.Message != "no such greeting" {
+		t.Errorf("expected NOT_FOUND as 404, got %d %s", resp.StatusCode, data)
+	}
+	if len(body.Details) != 1 || body.Details[0]["resourceName"] != "nobody" {
+		t.Errorf("expected the decoded ResourceInfo detail, got %s", data)
+	}
+
+	if resp, err := g.RoundTrip(grpcRequest(addr, `{"hello":`)); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a malformed body to be a 400, got %v %v", resp, err)
+	}
+
+	// nothing listens there, the proxy answers 502
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	l.Close()
+	if _, err := g.RoundTrip(grpcRequest(l.Addr().String(), `{}`)); err == nil {
+		t.Error("expected an unreachable upstream to be a transport error")
+	}
+}
+
+func TestGrpcQuery(t *testing.T) {
+	addr, _ := startGrpcUpstream(t, true)
+	g := NewDefaultGrpcTransport(nil)
+	defer g.(io.Closer).Close()
+
+	req := grpcRequest(addr, "")
+	req.URL.RawQuery = "hello=ni%20hao"
+	resp, err := g.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || !strings.Contains(string(data), "世界 ni hao") {
+		t.Errorf("expected the query to set hello, got %d %s", resp.StatusCode, data)
+	}
+
+	req = grpcRequest(addr, "")
+	req.URL.RawQuery = "goodbye=1"
+	resp, err = g.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadAll(resp.Body); resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(data), `unknown field \"goodbye\"`) {
+		t.Errorf("expected an unknown field to be a 400, got %d %s", resp.StatusCode, data)
+	}
+}
+
+func TestGrpcMetadata(t *testing.T) {
+	addr, _ := startGrpcUpstream(t, true)
+	g := NewDefaultGrpcTransport(&GrpcPoolConfig{Metadata: &GrpcMetadataConfig{
+		Allow:  []string{"Authorization", "X-User-*", "Cookie"},
+		Deny:   []string{"Cookie"},
+		Rename: map[string]string{"X-User-": "user-"},
+	}})
+	defer g.(io.Closer).Close()
+
+	req := grpcRequest(addr, `{"hello":"metadata"}`)
+	req.Header.Set("Authorization", "Bearer t0ken")
+	req.Header.Set("X-User-Id", "42")
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	// grpc can not send it, the call goes on without it
+	req.Header.Set("X-User-Name", "é")
+	resp, err := g.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	received := string(data)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the call to succeed, got %d %s", resp.StatusCode, data)
+	}
+	for _, key := range []string{"authorization", "user-id"} {
+		if !strings.Contains(received, key) {
+			t.Errorf("expected %s to be sent, got %s", key, received)
+		}
+	}
+	for _, key := range []string{"cookie", "x-user-id", "x-forwarded-for", "user-name"} {
+		if strings.Contains(received, key) {
+			t.Errorf("expected %s not to be sent, got %s", key, received)
+		}
+	}
+	if resp.Header.Get("Grpc-Metadata-X-Served-By") != "hello" || resp.Header.Get("Grpc-Trailer-X-Cost") != "1" {
+		t.Errorf("expected the response metadata as headers, got %v", resp.Header)
+	}
+}
+
+func TestMetadataRulesDefaults(t *testing.T) {
+	md := newMetadataRules(nil).fromHeader(http.Header{
+		"Authorization":          {"Basic eDp5"},
+		"Grpc-Metadata-Tenant":   {"acme"},
+		"Grpc-Metadata-Grpc-Foo": {"reserved"},
+		"Grpc-Timeout":           {"1S"},
+		"X-Other":                {"1"},
+		"Grpc-Metadata-Note":     {"line\nbreak"},
+		"Grpc-Metadata-Key+":     {"1"},
+		"Grpc-Metadata-Data-Bin": {"\x00\x01"},
+	})
+	if len(md) != 3 || md.Get("data-bin")[0] != "\x00\x01" || md.Get("authorization")[0] != "Basic eDp5" || md.Get("tenant")[0] != "acme" {
+		t.Errorf("expected authorization, tenant and data-bin, got %v", md)
+	}
+}
+
+func TestHTTPStatusFromGrpc(t *testing.T) {
+	for code, want := range map[codes.Code]int{
+		codes.OK:                http.StatusOK,
+		codes.InvalidArgument:   http.StatusBadRequest,
+		codes.NotFound:          http.StatusNotFound,
+		codes.PermissionDenied:  http.StatusForbidden,
+		codes.Unauthenticated:   http.StatusUnauthorized,
+		codes.ResourceExhausted: http.StatusTooManyRequests,
+		codes.Unimplemented:     http.StatusNotImplemented,
+		codes.Unavailable:       http.StatusServiceUnavailable,
+		codes.DeadlineExceeded:  http.StatusGatewayTimeout,
+		codes.DataLoss:          http.StatusInternalServerError,
+	} {
+		if got := httpStatusFromGrpc(code); got != want {
+			t.Errorf("expected %s to map to %d, got %d", code, want, got)
+		}
+	}
 }
 
 func BenchmarkInvokeRPC(b *testing.B) {
-	//g := NewDefaultGrpcTransport()
-	//content := "{\"hello\":\"nihao\"}"
+	addr, _ := startGrpcUpstream(b, true)
+	g := NewDefaultGrpcTransport(nil).(*defaultGrpcTransport)
+	defer g.Close()
+	content := `{"hello":"nihao"}`
 
-	//b.ResetTimer()
-	//for i := 0; i < b.N; i++ {
-	//	//g.invokeRPC(content, "localhost:8081", "proto.GrpcUpstreamService/Hello")
-	//}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := g.invokeRPC(context.Background(), content, addr, "proto.GrpcUpstreamService/Hello", nil, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
 }
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/fullstorydev/grpcurl"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// websocketReadLimit bounds the frames of clients like grpc bounds the messages it
+// receives by default.
+const websocketReadLimit = 4 << 20
+
+// websocketUpgrader accepts the WebSockets of the origins the CORS policy of the
+// route allows, of the gateway's own origin for routes without one.
+var websocketUpgrader = websocket.Upgrader{
+	CheckOrigin: checkWebSocketOrigin,
+}
+
+// checkWebSocketOrigin keeps pages of other sites from opening a socket with the
+// credentials of their visitors, browsers do not apply CORS to WebSockets.
+func checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if route := RequestRoute(r); route != nil && route.CORS != nil {
+		return route.CORS.AllowsOrigin(origin)
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// isWebSocket tells whether r asks to switch to a WebSocket.
+func isWebSocket(r *http.Request) bool {
+	return websocket.IsWebSocketUpgrade(r)
+}
+
+// websocketCloseCode is the close code of a call which ended with code: a normal
+// closure for OK, 4000 plus the code otherwise.
+func websocketCloseCode(code codes.Code) int {
+	if code == codes.OK {
+		return websocket.CloseNormalClosure
+	}
+	return 4000 + int(code)
+}
+
+// closeReason cuts msg to fit in a close frame.
+func closeReason(msg string) string {
+	const max = 123
+	for len(msg) > max {
+		_, size := utf8.DecodeLastRuneInString(msg)
+		msg = msg[:len(msg)-size]
+	}
+	return msg
+}
+
+// pipeResponseWriter lets the upgrader answer over one end of a pipe, the transport
+// reads the handshake from the other end like from an upstream.
+type pipeResponseWriter struct {
+	conn   net.Conn
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *pipeResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *pipeResponseWriter) WriteHeader(code int) {
+	w.code = code
+}
+
+func (w *pipeResponseWriter) Write(p []byte) (int, error) {
+	return w.body.Write(p)
+}
+
+func (w *pipeResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
+
+// upgradedConn is the gateway's end of the pipe, the proxy copies the client's
+// connection to and from it.
+type upgradedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *upgradedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// websocketRPC calls the client or bidi streaming method symbol for the WebSocket
+// r asks for. Every text frame of the client is a request, an empty one ends them,
+// and every response is a frame back. The socket is closed with the final status.
+func (g *defaultGrpcTransport) websocketRPC(req *http.Request, target, symbol string, headers []string, descSource grpcurl.DescriptorSource) (*http.Response, error) {
+	cc, release, err := g.pool.Get(target)
+	if err != nil {
+		fmt.Println(err, "Failed to dial target host", target)
+		observeGrpc(target, symbol, codes.Unavailable)
+		return nil, err
+	}
+	if descSource == nil {
+		descSource, _ = g.descriptors.get(target, cc)
+	}
+
+	// the upgrader only takes GET, the director put the grpc method in its place
+	upgradeReq := req.Clone(req.Context())
+	upgradeReq.Method = http.MethodGet
+
+	client, server := net.Pipe()
+	w := &pipeResponseWriter{conn: server, header: make(http.Header)}
+	refused := make(chan struct{})
+	go func() {
+		defer release()
+		conn, err := websocketUpgrader.Upgrade(w, upgradeReq, nil)
+		if err != nil {
+			close(refused)
+			server.Close()
+			return
+		}
+		g.websocketSession(req.Context(), conn, cc, target, symbol, headers, descSource)
+	}()
+
+	br := bufio.NewReader(client)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		client.Close()
+		select {
+		case <-refused:
+			if w.code != 0 {
+				return newResponse(req, w.code, w.header, w.body.Bytes()), nil
+			}
+		default:
+		}
+		return nil, err
+	}
+	resp.Body = &upgradedConn{Conn: client, r: br}
+	return resp, nil
+}
+
+func (g *defaultGrpcTransport) websocketSession(ctx context.Context, conn *websocket.Conn, cc *grpc.ClientConn, target, symbol string, headers []string, descSource grpcurl.DescriptorSource) {
+	defer conn.Close()
+	conn.SetReadLimit(websocketReadLimit)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	_, formatter, err := grpcurl.RequestParserAndFormatterFor(grpcurl.Format("json"), descSource, false, true, strings.NewReader(""))
+	if err != nil {
+		fmt.Println(err, "Failed to create formatter")
+		return
+	}
+	s := &websocketStream{
+		conn:        conn,
+		unmarshaler: jsonpb.Unmarshaler{AnyResolver: grpcurl.AnyResolverFromDescriptorSource(descSource)},
+		formatter:   formatter,
+		cancel:      cancel,
+		frames:      make(chan []byte),
+		done:        make(chan struct{}),
+	}
+	go s.read()
+
+	err = grpcurl.InvokeRPC(ctx, descSource, cc, symbol, headers, s, s.next)
+	s.finish()
+
+	st := s.status
+	if refused := s.refusal(); refused != nil {
+		st, err = refused, nil
+	}
+	if err != nil {
+		var ok bool
+		if st, ok = callErrorStatus(err); !ok {
+			fmt.Println(err, "Error invoking method", symbol)
+			st = status.New(codes.Unknown, err.Error())
+		}
+	}
+	observeGrpc(target, symbol, st.Code())
+
+	msg := websocket.FormatCloseMessage(websocketCloseCode(st.Code()), closeReason(st.Message()))
+	conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+}
+
+// websocketStream is the event handler and request supplier of a call over a
+// WebSocket.
+type websocketStream struct {
+	conn        *websocket.Conn
+	unmarshaler jsonpb.Unmarshaler
+	formatter   grpcurl.Formatter
+	cancel      context.CancelFunc
+
+	// frames are the text frames of the client, done is closed when the call no
+	// longer takes requests.
+	frames   chan []byte
+	done     chan struct{}
+	doneOnce sync.Once
+
+	status *status.Status
+
+	// refused is the status of a call the client sent a frame it can not take.
+	mu      sync.Mutex
+	refused *status.Status
+}
+
+// read passes the frames of the client on until it closes the socket, which cancels
+// the call if it still runs. Frames coming when the call is over are dropped, binary
+// ones end the call.
+func (s *websocketStream) read() {
+	defer close(s.frames)
+	for {
+		typ, data, err := s.conn.ReadMessage()
+		if err != nil {
+			s.cancel()
+			return
+		}
+		if typ != websocket.TextMessage {
+			s.mu.Lock()
+			s.refused = status.New(codes.InvalidArgument, "requests must be sent as text frames")
+			s.mu.Unlock()
+			s.cancel()
+			return
+		}
+		select {
+		case s.frames <- data:
+		case <-s.done:
+		}
+	}
+}
+
+func (s *websocketStream) refusal() *status.Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.refused
+}
+
+func (s *websocketStream) finish() {
+	s.doneOnce.Do(func() { close(s.done) })
+}
+
+// next is the request supplier of the call.
+func (s *websocketStream) next(m proto.Message) error {
+	select {
+	case data, ok := <-s.frames:
+		if !ok || len(bytes.TrimSpace(data)) == 0 {
+			return io.EOF
+		}
+		return s.unmarshaler.Unmarshal(bytes.NewReader(data), m)
+	case <-s.done:
+		return io.EOF
+	}
+}
+
+func (s *websocketStream) OnResolveMethod(*desc.MethodDescriptor) {}
+
+func (s *websocketStream) OnSendHeaders(metadata.MD) {}
+
+func (s *websocketStream) OnReceiveHeaders(metadata.MD) {}
+
+func (s *websocketStream) OnReceiveResponse(m proto.Message) {
+	out, err := s.formatter(m)
+	if err != nil {
+		fmt.Println(err, "Failed to format streamed response")
+		s.cancel()
+		return
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, []byte(out)); err == nil {
+		out = compact.String()
+	}
+	if err := s.conn.WriteMessage(websocket.TextMessage, []byte(out)); err != nil {
+		s.cancel()
+	}
+}
+
+func (s *websocketStream) OnReceiveTrailers(st *status.Status, _ metadata.MD) {
+	// a bidi call waits for its requests to stop before it returns
+	s.finish()
+	s.status = st
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// websocketGateway proxies /sum and /echo of the streaming upstream, and /echo-cors
+// with a CORS policy.
+func websocketGateway(t *testing.T) string {
+	_, _, u := startStreamingUpstream(t)
+	g := NewDefaultGrpcTransport(nil)
+	t.Cleanup(func() { g.(io.Closer).Close() })
+
+	sum, echo := *u, *u
+	sum.GrpcEndPoint, echo.GrpcEndPoint = "streaming.Streamer/Sum", "streaming.Streamer/Echo"
+	old := loadRoutes()
+	t.Cleanup(func() { currentRoutes.Store(old) })
+	setRoutes([]RouteSpec{
+		{Name: "sum", Path: "^/sum", Upstreams: []Upstream{sum}},
+		{Name: "echo-cors", Path: "^/echo-cors", Upstreams: []Upstream{echo}, CORS: &CORSPolicy{AllowOrigins: []string{"https://app.example.com"}}},
+		{Name: "echo", Path: "^/echo", Upstreams: []Upstream{echo}},
+	})
+
+	server := &Server{grpcTransport: g}
+	proxy := &httputil.ReverseProxy{Director: server.Director, Transport: server}
+	gateway := httptest.NewServer(withRequestContext(NewTimeoutHandler(proxy, time.Minute, "gateway timeout")))
+	t.Cleanup(gateway.Close)
+	return "ws" + strings.TrimPrefix(gateway.URL, "http")
+}
+
+// readFrames returns the text frames until the socket is closed, and how.
+func readFrames(t *testing.T, conn *websocket.Conn) ([]string, *websocket.CloseError) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var frames []string
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			ce, ok := err.(*websocket.CloseError)
+			if !ok {
+				t.Fatalf("expected a close frame, got %v", err)
+			}
+			return frames, ce
+		}
+		frames = append(frames, string(data))
+	}
+}
+
+func TestWebSocketClientStreaming(t *testing.T) {
+	url := websocketGateway(t)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"/sum", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, n := range []string{"1", "2", "3", ""} {
+		conn.WriteMessage(websocket.TextMessage, []byte(n))
+	}
+	frames, ce := readFrames(t, conn)
+	if len(frames) != 1 || frames[0] != "6" || ce.Code != websocket.CloseNormalClosure {
+		t.Errorf("expected the sum and a normal closure, got %v %v", frames, ce)
+	}
+
+	conn, _, err = websocket.DefaultDialer.Dial(url+"/sum", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"value":`))
+	if _, ce := readFrames(t, conn); ce.Code != 4000+3 {
+		t.Errorf("expected a malformed request to close with INVALID_ARGUMENT, got %v", ce)
+	}
+}
+
+func TestWebSocketBidiStreaming(t *testing.T) {
+	url := websocketGateway(t)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"/echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// every request is answered before the next is sent
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, s := range []string{`"hello"`, `"world"`} {
+		conn.WriteMessage(websocket.TextMessage, []byte(s))
+		if _, data, err := conn.ReadMessage(); err != nil || string(data) != s {
+			t.Fatalf("expected %s back, got %s %v", s, data, err)
+		}
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`"fail"`))
+	frames, ce := readFrames(t, conn)
+	if len(frames) != 0 || ce.Code != 4000+9 || ce.Text != "echo failed" {
+		t.Errorf("expected a FAILED_PRECONDITION closure, got %v %v", frames, ce)
+	}
+
+	// without the upgrade the requests are read from the body
+	resp, err := http.Post(strings.Replace(url, "ws", "http", 1)+"/sum", "application/json", strings.NewReader("1 2 3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if data, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || strings.TrimSpace(string(data)) != "6" {
+		t.Errorf("expected a plain request to sum its body, got %d %s", resp.StatusCode, data)
+	}
+}
+
+func TestWebSocketRefusals(t *testing.T) {
+	url := websocketGateway(t)
+	host := strings.TrimPrefix(url, "ws://")
+
+	for _, c := range []struct {
+		path, origin string
+		ok           bool
+	}{
+		{"/echo", "", true},
+		{"/echo", "http://" + host, true},
+		{"/echo", "https://evil.example.com", false},
+		{"/echo-cors", "https://app.example.com", true},
+		{"/echo-cors", "http://" + host, false},
+	} {
+		header := http.Header{}
+		if c.origin != "" {
+			header.Set("Origin", c.origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(url+c.path, header)
+		if err == nil {
+			conn.Close()
+		}
+		if (err == nil) != c.ok {
+			t.Errorf("%s from %q: expected accepted %v, got %v", c.path, c.origin, c.ok, err)
+		}
+		if !c.ok && (resp == nil || resp.StatusCode != http.StatusForbidden) {
+			t.Errorf("%s from %q: expected 403, got %v", c.path, c.origin, resp)
+		}
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"/echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteMessage(websocket.BinaryMessage, []byte(`"hello"`))
+	if frames, ce := readFrames(t, conn); len(frames) != 0 || ce.Code != 4000+3 {
+		t.Errorf("expected a binary frame to close with INVALID_ARGUMENT, got %v %v", frames, ce)
+	}
+
+	conn, _, err = websocket.DefaultDialer.Dial(url+"/echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteMessage(websocket.TextMessage, []byte(`"`+strings.Repeat("a", websocketReadLimit)+`"`))
+	if _, ce := readFrames(t, conn); ce.Code != websocket.CloseMessageTooBig {
+		t.Errorf("expected a frame over the limit to close the socket, got %v", ce)
+	}
+}
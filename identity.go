@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Identity is who the client proved to be. Filters read it with RequestIdentity;
+// authenticating filters replace it with SetRequestIdentity.
+type Identity struct {
+	Source     string // "mtls", "jwt", "apikey"
+	Subject    string
+	CommonName string
+	SPIFFEID   string
+	DNSNames   []string
+
+	Roles  []string
+	Scopes []string
+	Claims map[string]interface{}
+}
+
+// IdentityGrant gives roles and scopes to the identities matching Match, which is a
+// pattern as accepted by Identity.Matches. It is how mTLS clients get roles.
+type IdentityGrant struct {
+	Match  string   `json:"match"`
+	Roles  []string `json:"roles"`
+	Scopes []string `json:"scopes"`
+}
+
+var registeredGrants []IdentityGrant
+
+// identityFromTLS returns the identity of a verified client certificate, nil if the
+// client did not present one.
+func identityFromTLS(cs *tls.ConnectionState) *Identity {
+	if cs == nil || len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	cert := cs.VerifiedChains[0][0]
+	id := &Identity{
+		Source:     "mtls",
+		Subject:    cert.Subject.String(),
+		CommonName: cert.Subject.CommonName,
+		DNSNames:   cert.DNSNames,
+	}
+
+	for _, u := range cert.URIs {
+		if u.Scheme == "spiffe" {
+			id.SPIFFEID = u.String()
+			break
+		}
+	}
+
+	id.Claims = map[string]interface{}{
+		"sub": id.Subject,
+		"cn":  id.CommonName,
+	}
+	if id.SPIFFEID != "" {
+		id.Claims["spiffe_id"] = id.SPIFFEID
+	}
+
+	for _, g := range registeredGrants {
+		if id.Matches(g.Match) {
+			id.Roles = append(id.Roles, g.Roles...)
+			id.Scopes = append(id.Scopes, g.Scopes...)
+		}
+	}
+
+	return id
+}
+
+func (id *Identity) HasRole(role string) bool {
+	return containsString(id.Roles, role)
+}
+
+func (id *Identity) HasScope(scope string) bool {
+	return containsString(id.Scopes, scope)
+}
+
+// Claim returns a claim as a string, for list claims the values joined by ",".
+func (id *Identity) Claim(name string) (string, bool) {
+	v, ok := id.Claims[name]
+	if !ok {
+		return "", false
+	}
+	if list, ok := v.([]interface{}); ok {
+		values := make([]string, 0, len(list))
+		for _, item := range list {
+			values = append(values, fmt.Sprint(item))
+		}
+		return strings.Join(values, ","), true
+	}
+	return fmt.Sprint(v), true
+}
+
+// Matches reports whether the identity matches a pattern. Patterns are globs:
+// "spiffe://..." is matched against the SPIFFE ID, "cn:..." against the common name
+// and "dns:..." against the DNS SANs.
+func (id *Identity) Matches(pattern string) bool {
+	switch {
+	case strings.HasPrefix(pattern, "spiffe://"):
+		return globMatch(pattern, id.SPIFFEID)
+	case strings.HasPrefix(pattern, "cn:"):
+		return globMatch(strings.TrimPrefix(pattern, "cn:"), id.CommonName)
+	case strings.HasPrefix(pattern, "dns:"):
+		for _, name := range id.DNSNames {
+			if globMatch(strings.TrimPrefix(pattern, "dns:"), name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func globMatch(pattern, s string) bool {
+	if s == "" {
+		return false
+	}
+	ok, err := path.Match(pattern, s)
+	return err == nil && ok
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func RequestIdentity(r *http.Request) *Identity {
+	return getRequestContext(r).identity
+}
+
+func SetRequestIdentity(r *http.Request, id *Identity) {
+	getRequestContext(r).identity = id
+}
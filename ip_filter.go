@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+)
+
+func init() {
+	registeredFilters["ip_access"] = &IPAccessFilter{}
+}
+
+// IPAccessPolicy lists IPs and CIDRs of a route. Deny wins over Allow, an empty
+// Allow allows everybody not denied.
+type IPAccessPolicy struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+
+	once    sync.Once
+	allow   []*net.IPNet
+	deny    []*net.IPNet
+	invalid bool
+}
+
+func (p *IPAccessPolicy) compile() {
+	var err error
+	if p.allow, err = parseCIDRs(p.Allow); err != nil {
+		log.Printf("ip_access: invalid allow list, deny everybody: %v", err)
+		p.invalid = true
+	}
+	if p.deny, err = parseCIDRs(p.Deny); err != nil {
+		log.Printf("ip_access: invalid deny list, deny everybody: %v", err)
+		p.invalid = true
+	}
+}
+
+// Validate checks the lists, Allows denies everybody if they do not parse.
+func (p *IPAccessPolicy) Validate() error {
+	if _, err := parseCIDRs(p.Allow); err != nil {
+		return fmt.Errorf("invalid allow list: %v", err)
+	}
+	if _, err := parseCIDRs(p.Deny); err != nil {
+		return fmt.Errorf("invalid deny list: %v", err)
+	}
+	return nil
+}
+
+func (p *IPAccessPolicy) Allows(ip net.IP) bool {
+	p.once.Do(p.compile)
+
+	if p.invalid || ip == nil || containsIP(p.deny, ip) {
+		return false
+	}
+	return len(p.allow) == 0 || containsIP(p.allow, ip)
+}
+
+type IPAccessFilter struct{}
+
+func (f *IPAccessFilter) GetType() string {
+	return "PRE"
+}
+
+func (f *IPAccessFilter) GetOrder() int {
+	return -20
+}
+
+func (f *IPAccessFilter) ShouldFilter(r *http.Request) (bool, error) {
+	route := RequestRoute(r)
+	return route != nil && route.IPAccess != nil, nil
+}
+
+func (f *IPAccessFilter) Run(r *http.Request) error {
+	ip := RequestClientIP(r)
+	if !RequestRoute(r).IPAccess.Allows(ip) {
+		return &Abort{StatusCode: http.StatusForbidden, Message: "client ip " + ip.String() + " is not allowed"}
+	}
+	return nil
+}
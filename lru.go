@@ -0,0 +1,55 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lruCache is a map bounded to max entries, the least recently used entry is evicted
+// to make room for a new one.
+type lruCache struct {
+	mu    sync.Mutex
+	max   int
+	ll    *list.List // of *lruEntry, most recently used first
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+func newLRUCache(max int) *lruCache {
+	return &lruCache{
+		max:   max,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// getOrAdd returns the value of key, adding the one create returns if there is none.
+func (c *lruCache) getOrAdd(key string, create func() interface{}) interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		return e.Value.(*lruEntry).value
+	}
+
+	if c.ll.Len() >= c.max {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).key)
+	}
+
+	value := create()
+	c.items[key] = c.ll.PushFront(&lruEntry{key: key, value: value})
+	return value
+}
+
+func (c *lruCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
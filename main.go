@@ -1,34 +1,120 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
-	"net/http"
+	"log"
 	"net/http/httputil"
-	_ "net/http/pprof"
+	"os"
 	"sync"
 	"time"
 )
 
 func main() {
+	configPath := flag.String("config", os.Getenv("MINI_GATEWAY_CONFIG"), "path of the json config file")
+	testPolicy := flag.String("test-policy", "", "evaluate this policy file against -test-cases and exit")
+	testCases := flag.String("test-cases", "", "json file of policy test cases")
+	flag.Parse()
+
+	if *testPolicy != "" {
+		passed, err := RunPolicyTests(*testPolicy, *testCases, os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !passed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	configLoadTime.SetToCurrentTime()
+	loadedConfig, loadedConfigPath = cfg, *configPath
+	if err := setRoutes(cfg.Routes); err != nil {
+		log.Fatal(err)
+	}
+	registeredGrants = cfg.IdentityGrants
+	clientIPResolver, err = NewClientIPResolver(cfg.ClientIP.TrustedProxies, cfg.ClientIP.ForwardedHeader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	registeredPriorityClasses = cfg.PriorityClasses
+	registeredPolicies, err = LoadPolicies(cfg.Policies)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.TLS != nil {
+		tlsConfig, err = cfg.TLS.Build()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if cfg.Quota != nil {
+		quotaManager, err = NewQuotaManager(cfg.Quota, cfg.Consumers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go quotaManager.Run()
+	}
+
+	limitStore, failOpen := cfg.RateLimit.NewStore()
+
 	server := &Server{
-		port:          8080, // TODO configurable
-		httpTransport: http.DefaultTransport,
-		grpcTransport: NewDefaultGrpcTransport(),
+		port:          cfg.Port,
+		tlsConfig:     tlsConfig,
+		proxyProtocol: cfg.ClientIP.ProxyProtocol,
+		adminAddr:     cfg.Admin.Addr,
+		adminHandler:  withAdminAuth(adminMux, cfg.Admin.Token),
+		httpTransport: NewHTTPTransport(),
+		grpcTransport: NewDefaultGrpcTransport(cfg.Grpc),
+		routeLimiters: newRouteRateLimiters(limitStore, failOpen),
+		concurrency:   newConcurrencyLimiters(loadRoutes()),
+		health:        newUpstreamHealth(),
 		running:       false,
 		mu:            sync.Mutex{},
 	}
 
 	proxy := &httputil.ReverseProxy{Director: server.Director, Transport: server}
 
-	timeoutHandler := http.TimeoutHandler(proxy, 60*time.Second, "gateway timeout") // TODO configurable
-	rateLimiterHandler := NewRateLimiterHandler(timeoutHandler)
-	server.handler = rateLimiterHandler
+	timeoutHandler := NewTimeoutHandler(proxy, 60*time.Second, "gateway timeout") // TODO configurable
+	server.globalLimiter = NewRateLimiter("global", cfg.RateLimit.Rules, limitStore, failOpen)
+	rateLimiterHandler := NewRateLimiterHandler(timeoutHandler, server.globalLimiter)
+	handler := NewMetricsHandler(rateLimiterHandler)
+	if cfg.Tracing != nil {
+		shutdownTracing, err := InitTracing(cfg.Tracing)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer shutdownTracing(context.Background())
+	}
+	handler = NewTracingHandler(handler)
+	if cfg.AccessLog != nil {
+		accessLogger, err := NewAccessLogger(cfg.AccessLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler = NewAccessLogHandler(handler, accessLogger)
+	}
+	server.handler = withRequestContext(NewRequestIDHandler(handler))
 
 	server.running = true
-
-	//go http.ListenAndServe("0.0.0.0:8085", nil)
+	gatewayServer = server
 
 	fmt.Println(server.StartServe())
+
+	if quotaManager != nil {
+		if err := quotaManager.Flush(); err != nil {
+			log.Println("quota: flush:", err)
+		}
+	}
 }
 
 func timeMonitor(msg string, f func()) {
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc/codes"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func init() {
+	prometheus.MustRegister(
+		requestsTotal,
+		requestDuration,
+		upstreamDuration,
+		filterDuration,
+		rateLimitRejections,
+		concurrencyRejections,
+		grpcRequestsTotal,
+		grpcPoolConnections,
+		upstreamOpenConnections,
+		upstreamConnectionsAcquired,
+		configReloads,
+		configLoadTime,
+	)
+	adminMux.Handle("/metrics", promhttp.Handler())
+}
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mini_gateway_requests_total",
+		Help: "Requests answered, by route, upstream and status class.",
+	}, []string{"route", "upstream", "status_class"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mini_gateway_request_duration_seconds",
+		Help:    "Time to answer requests, by route, upstream and status class.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "upstream", "status_class"})
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mini_gateway_upstream_duration_seconds",
+		Help:    "Time of upstream round trips until the response headers, by route and upstream.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "upstream"})
+
+	filterDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mini_gateway_filter_duration_seconds",
+		Help:    "Time filters run, by filter and type.",
+		Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1},
+	}, []string{"filter", "type"})
+
+	rateLimitRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mini_gateway_rate_limit_rejections_total",
+		Help: "Requests rejected by rate limits and quotas, by scope: global, route or quota.",
+	}, []string{"scope", "route"})
+
+	concurrencyRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mini_gateway_concurrency_rejections_total",
+		Help: "Requests shed by concurrency limits, by route.",
+	}, []string{"route"})
+
+	grpcRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mini_gateway_grpc_requests_total",
+		Help: "gRPC calls to upstreams, by upstream, method and status code.",
+	}, []string{"upstream", "method", "code"})
+
+	grpcPoolConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mini_gateway_grpc_pool_connections",
+		Help: "gRPC connections kept in the pool, by upstream.",
+	}, []string{"upstream"})
+
+	upstreamOpenConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mini_gateway_upstream_open_connections",
+		Help: "Open HTTP connections to upstreams, by upstream.",
+	}, []string{"upstream"})
+
+	upstreamConnectionsAcquired = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mini_gateway_upstream_connections_acquired_total",
+		Help: "HTTP connections taken for upstream requests, by upstream and whether they were reused from the pool.",
+	}, []string{"upstream", "reused"})
+
+	// a reload forks a new process, which starts its own counters. The parent counts
+	// the reloads it attempted until it exits.
+	configReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mini_gateway_config_reloads_total",
+		Help: "Config reloads started by this process, by result.",
+	}, []string{"result"})
+
+	configLoadTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mini_gateway_config_load_timestamp_seconds",
+		Help: "When this process loaded its config.",
+	})
+)
+
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
+
+func routeLabel(route *RouteSpec) string {
+	if route == nil {
+		return ""
+	}
+	return route.ID()
+}
+
+func upstreamLabel(upstream *Upstream) string {
+	if upstream == nil {
+		return ""
+	}
+	return upstream.Host
+}
+
+func observeFilter(f Filter, d time.Duration) {
+	filterDuration.WithLabelValues(filterName(f), f.GetType()).Observe(d.Seconds())
+}
+
+var (
+	filterNamesOnce sync.Once
+	filterNames     map[Filter]string
+)
+
+// filterName returns the name f is registered with.
+func filterName(f Filter) string {
+	filterNamesOnce.Do(func() {
+		filterNames = make(map[Filter]string, len(registeredFilters))
+		for name, filter := range registeredFilters {
+			filterNames[filter] = name
+		}
+	})
+	return filterNames[f]
+}
+
+func observeGrpc(target, method string, code codes.Code) {
+	grpcRequestsTotal.WithLabelValues(target, method, code.String()).Inc()
+}
+
+// metricsHandler counts the requests once they are answered. It needs the request
+// context, so it goes inside withRequestContext.
+type metricsHandler struct {
+	next http.Handler
+}
+
+func NewMetricsHandler(next http.Handler) http.Handler {
+	return &metricsHandler{next: next}
+}
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	rw := &statusRecorder{ResponseWriter: w}
+
+	h.next.ServeHTTP(rw, r)
+
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+
+	rc := getRequestContext(r)
+	labels := []string{routeLabel(rc.route), upstreamLabel(rc.upstream), statusClass(rw.status)}
+	requestsTotal.WithLabelValues(labels...).Inc()
+	requestDuration.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+}
+
+// NewHTTPTransport returns the transport to HTTP upstreams, which reports its
+// connection pool in the metrics.
+func NewHTTPTransport() http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		upstreamOpenConnections.WithLabelValues(addr).Inc()
+		return &countedConn{Conn: conn, addr: addr}, nil
+	}
+
+	return &tracedTransport{next: t}
+}
+
+// countedConn decrements the open connections gauge once closed.
+type countedConn struct {
+	net.Conn
+	addr string
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		upstreamOpenConnections.WithLabelValues(c.addr).Dec()
+	})
+	return c.Conn.Close()
+}
+
+// tracedTransport counts whether requests got a pooled connection, and the attempts
+// after the first one as retries of the request: the transport sends idempotent
+// requests again when a pooled connection turns out to be closed.
+type tracedTransport struct {
+	next http.RoundTripper
+}
+
+func (t *tracedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	host := r.URL.Host
+	attempts := 0
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) {
+			attempts++
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			upstreamConnectionsAcquired.WithLabelValues(host, strconv.FormatBool(info.Reused)).Inc()
+		},
+	}
+	resp, err := t.next.RoundTrip(r.WithContext(httptrace.WithClientTrace(r.Context(), trace)))
+	if attempts > 1 {
+		getRequestContext(r).retries += attempts - 1
+	}
+	return resp, err
+}
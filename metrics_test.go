@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	route := &RouteSpec{Name: "metrics-test"}
+	h := withRequestContext(NewMetricsHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		getRequestContext(r).route = route
+		w.WriteHeader(http.StatusBadGateway)
+	})))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if n := testutil.ToFloat64(requestsTotal.WithLabelValues("metrics-test", "", "5xx")); n != 1 {
+		t.Fatalf("expected one request counted, got %v", n)
+	}
+
+	rec := httptest.NewRecorder()
+	adminMux.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(rec.Body)
+	if !strings.Contains(string(body), `mini_gateway_request_duration_seconds_count{route="metrics-test",status_class="5xx",upstream=""} 1`) {
+		t.Errorf("request duration missing from /metrics:\n%s", body)
+	}
+}
+
+func TestHTTPTransportCountsRetries(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// the upstream answers the first request, then drops the connection when the
+	// second one comes on it, and answers that on a new connection
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		br := bufio.NewReader(conn)
+		http.ReadRequest(br)
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+		http.ReadRequest(br)
+		conn.Close()
+
+		conn, err = ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		http.ReadRequest(bufio.NewReader(conn))
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+	}()
+
+	transport := NewHTTPTransport()
+	get := func() *requestContext {
+		rc := &requestContext{}
+		r, _ := http.NewRequest("GET", "http://"+ln.Addr().String()+"/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), requestContextKey{}, rc))
+		resp, err := transport.RoundTrip(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return rc
+	}
+
+	if rc := get(); rc.retries != 0 {
+		t.Errorf("expected no retries, got %d", rc.retries)
+	}
+	if rc := get(); rc.retries != 1 {
+		t.Errorf("expected the request to be retried once, got %d", rc.retries)
+	}
+}
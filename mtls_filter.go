@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+)
+
+func init() {
+	registeredFilters["mtls"] = &MTLSFilter{}
+}
+
+// MTLSFilter rejects requests without a verified client certificate and, when the
+// route lists AllowedClients, clients whose identity matches none of them.
+type MTLSFilter struct{}
+
+func (m *MTLSFilter) GetType() string {
+	return "PRE"
+}
+
+func (m *MTLSFilter) GetOrder() int {
+	return -1
+}
+
+func (m *MTLSFilter) ShouldFilter(r *http.Request) (bool, error) {
+	return true, nil
+}
+
+func (m *MTLSFilter) Run(r *http.Request) error {
+	id := RequestIdentity(r)
+	if id == nil {
+		return &Abort{StatusCode: http.StatusUnauthorized, Message: "client certificate required"}
+	}
+
+	route := RequestRoute(r)
+	if route == nil || len(route.AllowedClients) == 0 {
+		return nil
+	}
+
+	for _, pattern := range route.AllowedClients {
+		if id.Matches(pattern) {
+			return nil
+		}
+	}
+
+	return &Abort{StatusCode: http.StatusForbidden, Message: "client " + id.Subject + " is not allowed"}
+}
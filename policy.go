@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/cel-go/cel"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Policy is a CEL expression evaluating to a bool, true allows the request. The
+// expression sees these variables:
+//
+//	method    string               method the client sent
+//	path      string               path the client sent
+//	headers   map(string, string)  request headers, lower case names
+//	claims    map(string, dyn)     claims of the request identity
+//	roles     list(string)         roles of the request identity
+//	scopes    list(string)         scopes of the request identity
+//	client_ip string
+//	time      timestamp            when the request arrived
+type Policy struct {
+	Name string
+	prg  cel.Program
+}
+
+// PolicyInput is the request as seen by a policy.
+type PolicyInput struct {
+	Method   string                 `json:"method"`
+	Path     string                 `json:"path"`
+	Headers  map[string]string      `json:"headers"`
+	Claims   map[string]interface{} `json:"claims"`
+	Roles    []string               `json:"roles"`
+	Scopes   []string               `json:"scopes"`
+	ClientIP string                 `json:"client_ip"`
+	Time     time.Time              `json:"time"`
+}
+
+var registeredPolicies = map[string]*Policy{}
+
+var policyEnv *cel.Env
+
+func init() {
+	var err error
+	policyEnv, err = cel.NewEnv(
+		cel.Variable("method", cel.StringType),
+		cel.Variable("path", cel.StringType),
+		cel.Variable("headers", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("claims", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("roles", cel.ListType(cel.StringType)),
+		cel.Variable("scopes", cel.ListType(cel.StringType)),
+		cel.Variable("client_ip", cel.StringType),
+		cel.Variable("time", cel.TimestampType),
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func CompilePolicy(name, expr string) (*Policy, error) {
+	ast, issues := policyEnv.Compile(expr)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("policy %s: %v", name, issues.Err())
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("policy %s: evaluates to %s, want bool", name, ast.OutputType())
+	}
+
+	prg, err := policyEnv.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("policy %s: %v", name, err)
+	}
+
+	return &Policy{Name: name, prg: prg}, nil
+}
+
+func LoadPolicy(name, path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can not read policy %s: %v", path, err)
+	}
+	return CompilePolicy(name, string(data))
+}
+
+// LoadPolicies compiles the policy files of the config, keyed by policy name.
+func LoadPolicies(files map[string]string) (map[string]*Policy, error) {
+	policies := make(map[string]*Policy, len(files))
+	for name, path := range files {
+		p, err := LoadPolicy(name, path)
+		if err != nil {
+			return nil, err
+		}
+		policies[name] = p
+	}
+	return policies, nil
+}
+
+func (p *Policy) Eval(in *PolicyInput) (bool, error) {
+	vars := map[string]interface{}{
+		"method":    in.Method,
+		"path":      in.Path,
+		"headers":   nonNilStrings(in.Headers),
+		"claims":    nonNilClaims(in.Claims),
+		"roles":     nonNilList(in.Roles),
+		"scopes":    nonNilList(in.Scopes),
+		"client_ip": in.ClientIP,
+		"time":      in.Time,
+	}
+
+	out, _, err := p.prg.Eval(vars)
+	if err != nil {
+		return false, fmt.Errorf("policy %s: %v", p.Name, err)
+	}
+
+	allowed, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("policy %s: evaluated to %v", p.Name, out.Value())
+	}
+	return allowed, nil
+}
+
+func nonNilStrings(m map[string]string) map[string]string {
+	if m == nil {
+		return map[string]string{}
+	}
+	return m
+}
+
+func nonNilClaims(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return map[string]interface{}{}
+	}
+	return m
+}
+
+func nonNilList(l []string) []string {
+	if l == nil {
+		return []string{}
+	}
+	return l
+}
+
+func policyInputFromRequest(r *http.Request) *PolicyInput {
+	method, path := RequestMethodAndPath(r)
+	in := &PolicyInput{
+		Method:  method,
+		Path:    path,
+		Headers: make(map[string]string, len(r.Header)),
+		Time:    time.Now(),
+	}
+
+	for k, v := range r.Header {
+		in.Headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+
+	if ip := RequestClientIP(r); ip != nil {
+		in.ClientIP = ip.String()
+	}
+
+	if id := RequestIdentity(r); id != nil {
+		in.Claims = id.Claims
+		in.Roles = id.Roles
+		in.Scopes = id.Scopes
+	}
+
+	return in
+}
+
+// PolicyTestCase is one case of a policy test file, used by the -test-policy flag.
+type PolicyTestCase struct {
+	Name  string      `json:"name"`
+	Input PolicyInput `json:"input"`
+	Allow bool        `json:"allow"`
+}
+
+// RunPolicyTests evaluates a policy file against a json file holding a list of
+// PolicyTestCase and reports each case to out. It returns false if any case failed.
+func RunPolicyTests(policyPath, casesPath string, out io.Writer) (bool, error) {
+	p, err := LoadPolicy(policyPath, policyPath)
+	if err != nil {
+		return false, err
+	}
+
+	data, err := ioutil.ReadFile(casesPath)
+	if err != nil {
+		return false, fmt.Errorf("can not read test cases %s: %v", casesPath, err)
+	}
+
+	var cases []PolicyTestCase
+	if err := json.Unmarshal(data, &cases); err != nil {
+		return false, fmt.Errorf("can not parse test cases %s: %v", casesPath, err)
+	}
+
+	passed := true
+	for i, c := range cases {
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("case %d", i)
+		}
+
+		got, err := p.Eval(&c.Input)
+		switch {
+		case err != nil:
+			passed = false
+			fmt.Fprintf(out, "FAIL %s: %v\n", name, err)
+		case got != c.Allow:
+			passed = false
+			fmt.Fprintf(out, "FAIL %s: allow=%v, want %v\n", name, got, c.Allow)
+		default:
+			fmt.Fprintf(out, "ok   %s\n", name)
+		}
+	}
+
+	return passed, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+func init() {
+	registeredFilters["policy"] = &PolicyFilter{}
+}
+
+// PolicyFilter denies requests for which the route's Policy does not evaluate to
+// true. Evaluation errors deny as well.
+type PolicyFilter struct{}
+
+func (f *PolicyFilter) GetType() string {
+	return "PRE"
+}
+
+func (f *PolicyFilter) GetOrder() int {
+	return 2
+}
+
+func (f *PolicyFilter) ShouldFilter(r *http.Request) (bool, error) {
+	route := RequestRoute(r)
+	return route != nil && route.Policy != "", nil
+}
+
+func (f *PolicyFilter) Run(r *http.Request) error {
+	route := RequestRoute(r)
+	p, ok := registeredPolicies[route.Policy]
+	if !ok {
+		log.Printf("policy: unknown policy %s on route %s", route.Policy, route.Path)
+		return &Abort{StatusCode: http.StatusForbidden, Message: "forbidden"}
+	}
+
+	in := policyInputFromRequest(r)
+	allowed, err := p.Eval(in)
+	if err != nil {
+		log.Printf("policy: %v", err)
+		return &Abort{StatusCode: http.StatusForbidden, Message: "forbidden"}
+	}
+	if !allowed {
+		log.Printf("policy: %s denies %s %s", p.Name, in.Method, in.Path)
+		return &Abort{StatusCode: http.StatusForbidden, Message: "forbidden"}
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPolicyEval(t *testing.T) {
+	p, err := CompilePolicy("test", `
+		// admins always, others only read during office hours
+		"admin" in roles ||
+		(method == "GET" && path.startsWith("/svc1/") &&
+		 claims["tenant"] == headers["x-tenant"] &&
+		 time.getHours("UTC") >= 8 && time.getHours("UTC") < 18)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	office := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	night := time.Date(2020, 1, 1, 22, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name string
+		in   PolicyInput
+		want bool
+	}{
+		{"admin", PolicyInput{Method: "DELETE", Path: "/x", Roles: []string{"admin"}, Time: night}, true},
+		{"tenant read", PolicyInput{Method: "GET", Path: "/svc1/a", Claims: map[string]interface{}{"tenant": "acme"}, Headers: map[string]string{"x-tenant": "acme"}, Time: office}, true},
+		{"other tenant", PolicyInput{Method: "GET", Path: "/svc1/a", Claims: map[string]interface{}{"tenant": "acme"}, Headers: map[string]string{"x-tenant": "other"}, Time: office}, false},
+		{"at night", PolicyInput{Method: "GET", Path: "/svc1/a", Claims: map[string]interface{}{"tenant": "acme"}, Headers: map[string]string{"x-tenant": "acme"}, Time: night}, false},
+	}
+
+	for _, c := range cases {
+		got, err := p.Eval(&c.in)
+		if err != nil {
+			got = false
+		}
+		if got != c.want {
+			t.Errorf("%s: got %v (%v), want %v", c.name, got, err, c.want)
+		}
+	}
+
+	if _, err := CompilePolicy("bad", `method + "x"`); err == nil {
+		t.Error("non bool policy compiled")
+	}
+}
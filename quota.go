@@ -0,0 +1,430 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+func init() {
+	adminMux.HandleFunc("/quotas/", handleQuotaAdmin)
+}
+
+type QuotaConfig struct {
+	Plans map[string]QuotaPlan `json:"plans"`
+	// DefaultPlan applies to consumers without a plan, empty means no quota.
+	DefaultPlan string `json:"default_plan"`
+
+	// File keeps the counters across restarts, empty keeps them in memory only.
+	File string `json:"file"`
+	// FlushInterval is how often counters are written to File, defaults to 10s.
+	FlushInterval Duration `json:"flush_interval"`
+	// TimeZone the windows align to, defaults to UTC.
+	TimeZone string `json:"time_zone"`
+}
+
+type QuotaPlan struct {
+	Limits []QuotaLimit `json:"limits"`
+}
+
+type QuotaLimit struct {
+	// Period is "hour", "day" or "month", windows start at the beginning of the
+	// calendar period.
+	Period string `json:"period"`
+	Limit  int64  `json:"limit"`
+}
+
+// Consumer is a client of the gateway, identified by the subject of its identity.
+type Consumer struct {
+	Name string `json:"name"`
+	Plan string `json:"plan"`
+}
+
+// QuotaManager counts the requests of every consumer per plan limit window.
+//
+// The file holds totals. Every process adds what it counted since its last flush
+// to what is in the file, so the parent and the child of a reload can both flush.
+type QuotaManager struct {
+	cfg *QuotaConfig
+	loc *time.Location
+
+	consumersMu sync.RWMutex
+	consumers   map[string]string // consumer -> plan
+
+	mu       sync.Mutex
+	counters map[string]*quotaCounter
+}
+
+type quotaCounter struct {
+	Consumer string    `json:"consumer"`
+	Period   string    `json:"period"`
+	Start    time.Time `json:"start"`
+	Count    int64     `json:"count"`
+
+	// unflushed is the part of Count not in the file yet.
+	unflushed int64
+}
+
+// QuotaStatus is the state of one limit of a consumer.
+type QuotaStatus struct {
+	Period    string    `json:"period"`
+	Limit     int64     `json:"limit"`
+	Used      int64     `json:"used"`
+	Remaining int64     `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+}
+
+var quotaManager *QuotaManager
+
+func NewQuotaManager(cfg *QuotaConfig, consumers []Consumer) (*QuotaManager, error) {
+	loc := time.UTC
+	if cfg.TimeZone != "" {
+		var err error
+		if loc, err = time.LoadLocation(cfg.TimeZone); err != nil {
+			return nil, fmt.Errorf("invalid quota time_zone: %v", err)
+		}
+	}
+
+	for name, plan := range cfg.Plans {
+		for _, l := range plan.Limits {
+			if _, err := windowStart(l.Period, time.Now(), loc); err != nil {
+				return nil, fmt.Errorf("plan %s: %v", name, err)
+			}
+		}
+	}
+
+	m := &QuotaManager{
+		cfg:      cfg,
+		loc:      loc,
+		counters: make(map[string]*quotaCounter),
+	}
+	m.SetConsumers(consumers)
+
+	if err := m.Flush(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func windowStart(period string, t time.Time, loc *time.Location) (time.Time, error) {
+	t = t.In(loc)
+	switch period {
+	case "hour":
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc), nil
+	case "day":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc), nil
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc), nil
+	}
+	return time.Time{}, fmt.Errorf("unknown quota period %q", period)
+}
+
+func windowEnd(period string, start time.Time) time.Time {
+	switch period {
+	case "hour":
+		return start.Add(time.Hour)
+	case "day":
+		return start.AddDate(0, 0, 1)
+	default:
+		return start.AddDate(0, 1, 0)
+	}
+}
+
+func counterKey(consumer, period string, start time.Time) string {
+	return consumer + "|" + period + "|" + start.UTC().Format(time.RFC3339)
+}
+
+// SetConsumers replaces the consumers and their plans, the counters are kept.
+func (m *QuotaManager) SetConsumers(consumers []Consumer) {
+	plans := make(map[string]string, len(consumers))
+	for _, c := range consumers {
+		plans[c.Name] = c.Plan
+	}
+
+	m.consumersMu.Lock()
+	m.consumers = plans
+	m.consumersMu.Unlock()
+}
+
+func (m *QuotaManager) plan(consumer string) (QuotaPlan, bool) {
+	m.consumersMu.RLock()
+	name, ok := m.consumers[consumer]
+	m.consumersMu.RUnlock()
+	if !ok || name == "" {
+		name = m.cfg.DefaultPlan
+	}
+	plan, ok := m.cfg.Plans[name]
+	return plan, ok
+}
+
+// Take counts a request of the consumer unless that exceeds one of its limits. The
+// statuses are returned either way, nil if the consumer has no plan.
+func (m *QuotaManager) Take(consumer string, now time.Time) (bool, []QuotaStatus) {
+	plan, ok := m.plan(consumer)
+	if !ok {
+		return true, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counters := make([]*quotaCounter, len(plan.Limits))
+	allowed := true
+	for i, l := range plan.Limits {
+		counters[i] = m.counter(consumer, l.Period, now)
+		if counters[i].Count >= l.Limit {
+			allowed = false
+		}
+	}
+
+	if allowed {
+		for _, c := range counters {
+			c.Count++
+			c.unflushed++
+		}
+	}
+
+	statuses := make([]QuotaStatus, len(plan.Limits))
+	for i, l := range plan.Limits {
+		statuses[i] = newQuotaStatus(l, counters[i])
+	}
+	return allowed, statuses
+}
+
+// counter must be called with m.mu held.
+func (m *QuotaManager) counter(consumer, period string, now time.Time) *quotaCounter {
+	start, _ := windowStart(period, now, m.loc)
+	key := counterKey(consumer, period, start)
+	c, ok := m.counters[key]
+	if !ok {
+		c = &quotaCounter{Consumer: consumer, Period: period, Start: start}
+		m.counters[key] = c
+	}
+	return c
+}
+
+func newQuotaStatus(l QuotaLimit, c *quotaCounter) QuotaStatus {
+	s := QuotaStatus{
+		Period: l.Period,
+		Limit:  l.Limit,
+		Used:   c.Count,
+		Reset:  windowEnd(l.Period, c.Start),
+	}
+	if c.Count < l.Limit {
+		s.Remaining = l.Limit - c.Count
+	}
+	return s
+}
+
+// Status returns the statuses of the consumer's limits in the current windows.
+func (m *QuotaManager) Status(consumer string, now time.Time) []QuotaStatus {
+	plan, ok := m.plan(consumer)
+	if !ok {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	statuses := make([]QuotaStatus, 0, len(plan.Limits))
+	for _, l := range plan.Limits {
+		statuses = append(statuses, newQuotaStatus(l, m.counter(consumer, l.Period, now)))
+	}
+	return statuses
+}
+
+// Reset forgets the usage of a consumer, in memory and in the file.
+func (m *QuotaManager) Reset(consumer string) error {
+	m.mu.Lock()
+	for key, c := range m.counters {
+		if c.Consumer == consumer {
+			delete(m.counters, key)
+		}
+	}
+	m.mu.Unlock()
+
+	return m.sync(func(stored map[string]*quotaCounter) {
+		for key, c := range stored {
+			if c.Consumer == consumer {
+				delete(stored, key)
+			}
+		}
+	})
+}
+
+// Flush adds the unflushed counts to the file and reloads the totals from it.
+func (m *QuotaManager) Flush() error {
+	return m.sync(nil)
+}
+
+func (m *QuotaManager) sync(change func(stored map[string]*quotaCounter)) error {
+	if m.cfg.File == "" {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if change != nil {
+			change(m.counters)
+		}
+		pruneQuotaCounters(m.counters, time.Now())
+		return nil
+	}
+
+	lock, err := os.OpenFile(m.cfg.File+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	stored, err := readQuotaFile(m.cfg.File)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, c := range m.counters {
+		if c.unflushed == 0 {
+			continue
+		}
+		s, ok := stored[key]
+		if !ok {
+			s = &quotaCounter{Consumer: c.Consumer, Period: c.Period, Start: c.Start}
+			stored[key] = s
+		}
+		s.Count += c.unflushed
+	}
+
+	if change != nil {
+		change(stored)
+	}
+
+	pruneQuotaCounters(stored, time.Now())
+
+	if err := writeQuotaFile(m.cfg.File, stored); err != nil {
+		return err
+	}
+
+	m.counters = stored
+	return nil
+}
+
+// pruneQuotaCounters drops the counters of past windows.
+func pruneQuotaCounters(counters map[string]*quotaCounter, now time.Time) {
+	for key, c := range counters {
+		if !windowEnd(c.Period, c.Start).After(now) {
+			delete(counters, key)
+		}
+	}
+}
+
+func readQuotaFile(path string) (map[string]*quotaCounter, error) {
+	stored := make(map[string]*quotaCounter)
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return stored, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*quotaCounter
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("can not parse quota file %s: %v", path, err)
+	}
+	for _, c := range list {
+		stored[counterKey(c.Consumer, c.Period, c.Start)] = c
+	}
+	return stored, nil
+}
+
+func writeQuotaFile(path string, stored map[string]*quotaCounter) error {
+	list := make([]*quotaCounter, 0, len(stored))
+	for _, c := range stored {
+		list = append(list, c)
+	}
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Run flushes the counters every FlushInterval.
+func (m *QuotaManager) Run() {
+	interval := time.Duration(m.cfg.FlushInterval)
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	for range time.Tick(interval) {
+		if err := m.Flush(); err != nil {
+			log.Println("quota: flush:", err)
+		}
+	}
+}
+
+// quotaStatusHeader formats statuses like "day;limit=100;remaining=42;reset=3600".
+func quotaStatusHeader(statuses []QuotaStatus, now time.Time) string {
+	parts := make([]string, 0, len(statuses))
+	for _, s := range statuses {
+		parts = append(parts, fmt.Sprintf("%s;limit=%d;remaining=%d;reset=%d",
+			s.Period, s.Limit, s.Remaining, ceilSeconds(s.Reset.Sub(now))))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// handleQuotaAdmin serves GET /quotas/<consumer> and DELETE /quotas/<consumer>,
+// which resets the usage of the consumer.
+func handleQuotaAdmin(w http.ResponseWriter, r *http.Request) {
+	consumer := strings.TrimPrefix(r.URL.Path, "/quotas/")
+	if quotaManager == nil || consumer == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"consumer": consumer,
+			"quotas":   quotaManager.Status(consumer, time.Now()),
+		})
+	case http.MethodDelete:
+		if err := quotaManager.Reset(consumer); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
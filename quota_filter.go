@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func init() {
+	registeredFilters["quota"] = &QuotaFilter{}
+}
+
+const quotaStatusHeaderKey = "X-Quota-Status"
+
+// QuotaFilter enforces the plan quotas of the consumer, requests without identity
+// are not counted.
+type QuotaFilter struct{}
+
+func (f *QuotaFilter) GetType() string {
+	return "PRE"
+}
+
+func (f *QuotaFilter) GetOrder() int {
+	// after authentication and authorization, denied requests do not count.
+	return 10
+}
+
+func (f *QuotaFilter) ShouldFilter(r *http.Request) (bool, error) {
+	return quotaManager != nil && RequestIdentity(r) != nil, nil
+}
+
+func (f *QuotaFilter) Run(r *http.Request) error {
+	now := time.Now()
+	allowed, statuses := quotaManager.Take(RequestIdentity(r).Subject, now)
+	if len(statuses) == 0 {
+		return nil
+	}
+
+	status := quotaStatusHeader(statuses, now)
+	if allowed {
+		ResponseHeader(r).Set(quotaStatusHeaderKey, status)
+		return nil
+	}
+
+	var retryAfter time.Duration
+	for _, s := range statuses {
+		if s.Remaining == 0 && s.Reset.Sub(now) > retryAfter {
+			retryAfter = s.Reset.Sub(now)
+		}
+	}
+
+	rateLimitRejections.WithLabelValues("quota", routeLabel(RequestRoute(r))).Inc()
+
+	h := make(http.Header)
+	h.Set(quotaStatusHeaderKey, status)
+	h.Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+	return &Abort{StatusCode: http.StatusTooManyRequests, Message: "quota exceeded", Header: h}
+}
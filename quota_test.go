@@ -0,0 +1,74 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQuotaWindows(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	now := time.Date(2020, 3, 31, 23, 30, 0, 0, loc)
+	start, _ := windowStart("day", now, loc)
+	if !start.Equal(time.Date(2020, 3, 31, 0, 0, 0, 0, loc)) || !windowEnd("day", start).Equal(time.Date(2020, 4, 1, 0, 0, 0, 0, loc)) {
+		t.Errorf("day window %v", start)
+	}
+
+	start, _ = windowStart("month", now.UTC(), loc)
+	if !start.Equal(time.Date(2020, 3, 1, 0, 0, 0, 0, loc)) {
+		t.Errorf("month window %v", start)
+	}
+}
+
+func TestQuotaManager(t *testing.T) {
+	cfg := &QuotaConfig{
+		Plans: map[string]QuotaPlan{
+			"free": {Limits: []QuotaLimit{{Period: "day", Limit: 3}, {Period: "month", Limit: 100}}},
+		},
+		File: filepath.Join(t.TempDir(), "quota.json"),
+	}
+	consumers := []Consumer{{Name: "alice", Plan: "free"}}
+	now := time.Now()
+
+	m, err := NewQuotaManager(cfg, consumers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, statuses := m.Take("bob", now); !ok || statuses != nil {
+		t.Error("consumer without plan is limited")
+	}
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := m.Take("alice", now); !ok {
+			t.Fatalf("request %d denied", i)
+		}
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted gateway continues where the old one stopped
+	m2, err := NewQuotaManager(cfg, consumers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, statuses := m2.Take("alice", now)
+	if !ok || statuses[0].Remaining != 0 || statuses[1].Remaining != 97 {
+		t.Fatalf("after restart: %v %+v", ok, statuses)
+	}
+	if ok, _ := m2.Take("alice", now); ok {
+		t.Error("daily quota not enforced")
+	}
+
+	if err := m2.Reset("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := m2.Take("alice", now); !ok {
+		t.Error("denied after reset")
+	}
+}
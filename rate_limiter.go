@@ -2,52 +2,373 @@ package main
 
 import (
 	"golang.org/x/time/rate"
+	"log"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-// TODO how to customize condtions.
-type condition struct {
-	ip string
+const defaultRateLimitMaxKeys = 10000
+
+type RateLimitConfig struct {
+	Rules []RateLimitRule `json:"rules"`
+	// MaxKeys bounds the limiters kept per rule, the least recently used are evicted
+	// first. Defaults to 10000.
+	MaxKeys int `json:"max_keys"`
+
+	// Redis shares the limiters between gateway instances, without it every
+	// instance limits on its own.
+	Redis *RedisRateLimitConfig `json:"redis"`
 }
 
-type rateLimiterHandler struct {
-	next http.Handler
+// NewStore returns the store the config asks for and whether to allow requests when
+// the store fails.
+func (c *RateLimitConfig) NewStore() (RateLimitStore, bool) {
+	if c.Redis != nil {
+		return newRedisRateLimitStore(c.Redis), c.Redis.FailOpen
+	}
+	return newLocalRateLimitStore(c.MaxKeys), false
+}
 
-	// TODO lims are read-only after gateway starts, no need to lock and unlock. Afterward, if we
-	// want to support dynamic loading rate limit configuration, we need to add sync.RWlock.
-	lims map[condition]*rate.Limiter
+// RateLimitRule limits the requests which produce the same descriptor values, every
+// distinct combination gets its own limiter.
+type RateLimitRule struct {
+	Name        string                `json:"name"`
+	Descriptors []RateLimitDescriptor `json:"descriptors"`
+	Rate        float64               `json:"rate"` // requests per second
+	Burst       int                   `json:"burst"`
+
+	// Algorithm is "token_bucket", the default, or "sliding_window" which allows
+	// Burst requests in any window of Burst/Rate seconds. Only the redis store
+	// implements sliding_window, the local store uses a token bucket for both.
+	Algorithm string `json:"algorithm"`
 }
 
-func NewRateLimiterHandler(next http.Handler) http.Handler {
-	limHandler := &rateLimiterHandler{
-		next: next,
-		lims: make(map[condition]*rate.Limiter),
+// RateLimitDescriptor works like an Envoy rate limit action. Key is the request
+// attribute: "client_ip", "consumer", "method", "path", "route" or "header:<name>".
+// When Value is set the rule only applies to requests whose attribute equals it. A
+// rule does not apply to requests missing one of its attributes.
+type RateLimitDescriptor struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func descriptorValue(key string, r *http.Request) string {
+	switch {
+	case key == "client_ip":
+		if ip := RequestClientIP(r); ip != nil {
+			return ip.String()
+		}
+	case key == "consumer":
+		if id := RequestIdentity(r); id != nil {
+			return id.Subject
+		}
+	case key == "method":
+		method, _ := RequestMethodAndPath(r)
+		return method
+	case key == "path":
+		_, path := RequestMethodAndPath(r)
+		return path
+	case key == "route":
+		if route := RequestRoute(r); route != nil {
+			return route.ID()
+		}
+		if route, _ := matchRoute(r.URL.Path); route != nil {
+			return route.ID()
+		}
+	case strings.HasPrefix(key, "header:"):
+		return r.Header.Get(strings.TrimPrefix(key, "header:"))
+	}
+	return ""
+}
+
+// key returns the limiter key of the request, false if the rule does not apply.
+func (rule *RateLimitRule) key(r *http.Request) (string, bool) {
+	values := make([]string, 0, len(rule.Descriptors))
+	for _, d := range rule.Descriptors {
+		v := descriptorValue(d.Key, r)
+		if v == "" || (d.Value != "" && v != d.Value) {
+			return "", false
+		}
+		values = append(values, d.Key+"="+v)
 	}
+	return strings.Join(values, "|"), true
+}
 
-	lim := rate.NewLimiter(rate.Limit(100), 100) // TODO configurable
-	con := condition{ip: "127.0.0.1"}
+// RateLimitStore keeps the state of the rate limit rules. key identifies the
+// limiter of the rule, a store must not share it with other rules.
+type RateLimitStore interface {
+	Take(rule *RateLimitRule, key string) (*RateLimitResult, error)
+}
 
-	limHandler.lims[con] = lim
+// localRateLimitStore keeps a token bucket per key in memory, at most maxKeys per
+// rule.
+type localRateLimitStore struct {
+	mu      sync.Mutex
+	maxKeys int
+	rules   map[*RateLimitRule]*lruCache
+}
 
-	return limHandler
+func newLocalRateLimitStore(maxKeys int) *localRateLimitStore {
+	if maxKeys <= 0 {
+		maxKeys = defaultRateLimitMaxKeys
+	}
+	return &localRateLimitStore{
+		maxKeys: maxKeys,
+		rules:   make(map[*RateLimitRule]*lruCache),
+	}
 }
 
-func (r *rateLimiterHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-	con := condition{
-		ip: strings.Split(req.RemoteAddr, ":")[0], // TODO handle special ip.
+func (s *localRateLimitStore) limiters(rule *RateLimitRule) *lruCache {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.rules[rule]
+	if !ok {
+		c = newLRUCache(s.maxKeys)
+		s.rules[rule] = c
 	}
+	return c
+}
 
-	var lim *rate.Limiter
-	var ok bool
-	if lim, ok = r.lims[con]; !ok {
-		r.next.ServeHTTP(resp, req)
-		return
+// activeKeys returns the number of limiters of the rule.
+func (s *localRateLimitStore) activeKeys(rule *RateLimitRule) int {
+	s.mu.Lock()
+	c, ok := s.rules[rule]
+	s.mu.Unlock()
+	if !ok {
+		return 0
 	}
+	return c.len()
+}
 
-	if lim.Allow() {
-		r.next.ServeHTTP(resp, req)
-	} else {
-		resp.WriteHeader(429)
+// forget drops the limiters of rules which are no longer applied.
+func (s *localRateLimitStore) forget(rules []*RateLimitRule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rule := range rules {
+		delete(s.rules, rule)
+	}
+}
+
+func (s *localRateLimitStore) Take(rule *RateLimitRule, key string) (*RateLimitResult, error) {
+	lim := s.limiters(rule).getOrAdd(key, func() interface{} {
+		return rate.NewLimiter(rate.Limit(rule.Rate), rule.Burst)
+	}).(*rate.Limiter)
+
+	return takeToken(lim, time.Now()), nil
+}
+
+// RateLimitResult is the outcome of the most restrictive rule for a request.
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is when the bucket will be full again, RetryAfter when the next request
+	// will be allowed.
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// Header returns the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset
+// headers, plus Retry-After for denied requests.
+func (res *RateLimitResult) Header() http.Header {
+	h := make(http.Header)
+	h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+	if !res.Allowed {
+		h.Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+	}
+	return h
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+func takeToken(lim *rate.Limiter, now time.Time) *RateLimitResult {
+	res := &RateLimitResult{
+		Allowed: lim.AllowN(now, 1),
+		Limit:   lim.Burst(),
+	}
+
+	tokens := lim.TokensAt(now)
+	if tokens > 0 {
+		res.Remaining = int(tokens)
+	}
+
+	perSecond := float64(lim.Limit())
+	if perSecond > 0 {
+		res.Reset = time.Duration((float64(lim.Burst()) - tokens) / perSecond * float64(time.Second))
+		if tokens < 1 {
+			res.RetryAfter = time.Duration((1 - tokens) / perSecond * float64(time.Second))
+		}
+	}
+
+	return res
+}
+
+// RateLimiter applies a set of rules.
+type RateLimiter struct {
+	// scope tells the limiters of different RateLimiters apart in a shared store.
+	scope    string
+	rules    []*RateLimitRule
+	store    RateLimitStore
+	failOpen bool
+}
+
+func NewRateLimiter(scope string, rules []RateLimitRule, store RateLimitStore, failOpen bool) *RateLimiter {
+	l := &RateLimiter{
+		scope:    scope,
+		store:    store,
+		failOpen: failOpen,
+	}
+	for i := range rules {
+		l.rules = append(l.rules, &rules[i])
 	}
+	return l
+}
+
+// Take takes a token from every rule applying to the request. It returns the result
+// of the rule which denied the request or else of the one with the fewest remaining
+// tokens, nil if no rule applies.
+func (l *RateLimiter) Take(r *http.Request) *RateLimitResult {
+	var result *RateLimitResult
+	for i, rule := range l.rules {
+		key, ok := rule.key(r)
+		if !ok {
+			continue
+		}
+
+		name := rule.Name
+		if name == "" {
+			name = strconv.Itoa(i)
+		}
+
+		res, err := l.store.Take(rule, l.scope+":"+name+":"+key)
+		if err != nil {
+			log.Printf("rate limit: %s %s: %v", l.scope, name, err)
+			if l.failOpen {
+				continue
+			}
+			res = &RateLimitResult{Limit: rule.Burst, RetryAfter: time.Second}
+		}
+
+		if !res.Allowed {
+			return res
+		}
+		if result == nil || res.Remaining < result.Remaining {
+			result = res
+		}
+	}
+
+	return result
+}
+
+// routeRateLimiters holds the RateLimiter of every route with RateLimits.
+type routeRateLimiters struct {
+	mu       sync.Mutex
+	store    RateLimitStore
+	failOpen bool
+	lims     map[*RouteSpec]*RateLimiter
+}
+
+func newRouteRateLimiters(store RateLimitStore, failOpen bool) *routeRateLimiters {
+	return &routeRateLimiters{
+		store:    store,
+		failOpen: failOpen,
+		lims:     make(map[*RouteSpec]*RateLimiter),
+	}
+}
+
+func (rl *routeRateLimiters) get(route *RouteSpec) *RateLimiter {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	lim, ok := rl.lims[route]
+	if !ok {
+		lim = rl.newLimiter(route)
+		rl.lims[route] = lim
+	}
+	return lim
+}
+
+// peek returns the limiter of the route without keeping it, a route no request took
+// yet gets a new one on the same store.
+func (rl *routeRateLimiters) peek(route *RouteSpec) *RateLimiter {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if lim, ok := rl.lims[route]; ok {
+		return lim
+	}
+	return rl.newLimiter(route)
+}
+
+func (rl *routeRateLimiters) newLimiter(route *RouteSpec) *RateLimiter {
+	return NewRateLimiter("route:"+route.ID(), route.RateLimits, rl.store, rl.failOpen)
+}
+
+// prune drops the limiters of the routes not in t, and their state in the store if
+// it keeps some per rule.
+func (rl *routeRateLimiters) prune(t *routeTable) {
+	live := make(map[*RouteSpec]bool, len(t.routes))
+	for _, route := range t.routes {
+		live[route] = true
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	var dead []*RateLimitRule
+	for route, lim := range rl.lims {
+		if !live[route] {
+			dead = append(dead, lim.rules...)
+			delete(rl.lims, route)
+		}
+	}
+	if s, ok := rl.store.(*localRateLimitStore); ok && len(dead) > 0 {
+		s.forget(dead)
+	}
+}
+
+// Take applies the rate limits of the request's route, see RateLimiter.Take.
+func (rl *routeRateLimiters) Take(r *http.Request) *RateLimitResult {
+	route := RequestRoute(r)
+	if route == nil || len(route.RateLimits) == 0 {
+		return nil
+	}
+	return rl.get(route).Take(r)
+}
+
+// rateLimiterHandler applies the global rate limits, before routing.
+type rateLimiterHandler struct {
+	next http.Handler
+
+	// the limiter is read-only after the gateway starts, a config reload forks a new
+	// process.
+	lim *RateLimiter
+}
+
+func NewRateLimiterHandler(next http.Handler, lim *RateLimiter) http.Handler {
+	return &rateLimiterHandler{
+		next: next,
+		lim:  lim,
+	}
+}
+
+func (r *rateLimiterHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if res := r.lim.Take(req); res != nil && !res.Allowed {
+		rateLimitRejections.WithLabelValues("global", "").Inc()
+		for k, v := range res.Header() {
+			resp.Header()[k] = v
+		}
+		resp.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	r.next.ServeHTTP(resp, req)
 }
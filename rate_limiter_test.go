@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestRateLimitRuleKey(t *testing.T) {
+	rule := &RateLimitRule{Descriptors: []RateLimitDescriptor{
+		{Key: "client_ip"},
+		{Key: "header:X-Plan", Value: "free"},
+	}}
+
+	r := httptest.NewRequest("GET", "/svc1/a", nil)
+	r.RemoteAddr = "[2001:db8::1]:1234"
+	if _, ok := rule.key(r); ok {
+		t.Error("rule applies without its header")
+	}
+
+	r.Header.Set("X-Plan", "paid")
+	if _, ok := rule.key(r); ok {
+		t.Error("rule applies to another header value")
+	}
+
+	r.Header.Set("X-Plan", "free")
+	key, ok := rule.key(r)
+	if !ok || key != "client_ip=2001:db8::1|header:X-Plan=free" {
+		t.Errorf("got key %q %v", key, ok)
+	}
+}
+
+func TestRateLimiterHandler(t *testing.T) {
+	cfg := RateLimitConfig{
+		Rules:   []RateLimitRule{{Descriptors: []RateLimitDescriptor{{Key: "header:X-Key"}}, Rate: 1, Burst: 2}},
+		MaxKeys: 3,
+	}
+	store := newLocalRateLimitStore(cfg.MaxKeys)
+	h := NewRateLimiterHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), NewRateLimiter("global", cfg.Rules, store, false))
+
+	do := func(key string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Key", key)
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for i, want := range []int{200, 200, 429} {
+		if got := do("a"); got != want {
+			t.Errorf("request %d: got %d, want %d", i, got, want)
+		}
+	}
+	if got := do("b"); got != 200 {
+		t.Errorf("other key: got %d", got)
+	}
+
+	for i := 0; i < 10; i++ {
+		do(strconv.Itoa(i))
+	}
+	if n := store.limiters(&cfg.Rules[0]).len(); n != 3 {
+		t.Errorf("got %d limiters, want 3", n)
+	}
+}
+
+func TestRateLimitResultHeader(t *testing.T) {
+	rules := []RateLimitRule{{Descriptors: []RateLimitDescriptor{{Key: "method"}}, Rate: 0.5, Burst: 1}}
+	lim := NewRateLimiter("global", rules, newLocalRateLimitStore(0), false)
+	r := httptest.NewRequest("GET", "/", nil)
+
+	if res := lim.Take(r); !res.Allowed || res.Remaining != 0 {
+		t.Fatalf("first request: %+v", res)
+	}
+
+	h := lim.Take(r).Header()
+	if h.Get("RateLimit-Limit") != "1" || h.Get("RateLimit-Remaining") != "0" || h.Get("Retry-After") != "2" {
+		t.Errorf("got headers %v", h)
+	}
+}
+
+func TestRouteRateLimitersPrune(t *testing.T) {
+	store := newLocalRateLimitStore(10)
+	limiters := newRouteRateLimiters(store, false)
+	rule := []RateLimitRule{{Descriptors: []RateLimitDescriptor{{Key: "method"}}, Rate: 1, Burst: 1}}
+	kept := &RouteSpec{Name: "kept", RateLimits: rule}
+	dropped := &RouteSpec{Name: "dropped", RateLimits: append([]RateLimitRule{}, rule...)}
+
+	for _, route := range []*RouteSpec{kept, dropped} {
+		if res := limiters.get(route).Take(httptest.NewRequest("GET", "/", nil)); res == nil || !res.Allowed {
+			t.Fatalf("%s: expected the first request to pass, got %+v", route.Name, res)
+		}
+	}
+	if len(store.rules) != 2 {
+		t.Fatalf("expected the limiters of both rules, got %d", len(store.rules))
+	}
+
+	limiters.prune(&routeTable{routes: []*RouteSpec{kept}})
+	if len(limiters.lims) != 1 || len(store.rules) != 1 || store.rules[&kept.RateLimits[0]] == nil {
+		t.Errorf("expected only the kept route's limiters, got %d routes and %d rules", len(limiters.lims), len(store.rules))
+	}
+}
+
+func TestValidateGlobalRateLimits(t *testing.T) {
+	cfg := defaultConfig()
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.RateLimit = &RateLimitConfig{Rules: []RateLimitRule{{Name: "all", Descriptors: []RateLimitDescriptor{{Key: "client_ip"}}, Burst: 10}}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected a global rule without rate to be rejected")
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+)
+
+func init() {
+	registeredFilters["rbac"] = &RBACFilter{}
+}
+
+// RBACPolicy authorizes requests of a route against the request identity. Rules are
+// tried in order, the request is allowed by the first rule which matches its method
+// and path and whose requirements the identity meets. Everything else is denied.
+type RBACPolicy struct {
+	// DryRun logs the requests which would be denied but lets them through.
+	DryRun bool       `json:"dry_run"`
+	Rules  []RBACRule `json:"rules"`
+}
+
+type RBACRule struct {
+	// Methods the rule applies to, empty means all.
+	Methods []string `json:"methods"`
+	// Path is a glob on the path the client sent, a trailing "/**" matches any
+	// sub path. Empty means all.
+	Path string `json:"path"`
+
+	// Roles requires any of the roles, Scopes all of the scopes and Claims all of
+	// the claim values. A rule without requirements allows anonymous requests.
+	Roles  []string          `json:"roles"`
+	Scopes []string          `json:"scopes"`
+	Claims map[string]string `json:"claims"`
+}
+
+func (rule *RBACRule) appliesTo(method, p string) bool {
+	if len(rule.Methods) > 0 {
+		matched := false
+		for _, m := range rule.Methods {
+			if strings.EqualFold(m, method) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return rule.Path == "" || pathMatch(rule.Path, p)
+}
+
+// unmet returns why the identity does not meet the rule, "" if it does.
+func (rule *RBACRule) unmet(id *Identity) string {
+	if len(rule.Roles) == 0 && len(rule.Scopes) == 0 && len(rule.Claims) == 0 {
+		return ""
+	}
+	if id == nil {
+		return "no identity"
+	}
+
+	if len(rule.Roles) > 0 {
+		found := false
+		for _, role := range rule.Roles {
+			if id.HasRole(role) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Sprintf("needs one of roles %v", rule.Roles)
+		}
+	}
+
+	for _, scope := range rule.Scopes {
+		if !id.HasScope(scope) {
+			return fmt.Sprintf("needs scope %s", scope)
+		}
+	}
+
+	for name, want := range rule.Claims {
+		got, ok := id.Claim(name)
+		if !ok {
+			return fmt.Sprintf("needs claim %s", name)
+		}
+		if got != want {
+			return fmt.Sprintf("needs claim %s=%s, got %s", name, want, got)
+		}
+	}
+
+	return ""
+}
+
+// Decide returns whether the request is allowed and a human readable reason.
+func (p *RBACPolicy) Decide(method, reqPath string, id *Identity) (bool, string) {
+	var reasons []string
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if !rule.appliesTo(method, reqPath) {
+			continue
+		}
+		why := rule.unmet(id)
+		if why == "" {
+			return true, fmt.Sprintf("allowed by rule %d", i)
+		}
+		reasons = append(reasons, fmt.Sprintf("rule %d %s", i, why))
+	}
+
+	if len(reasons) == 0 {
+		return false, "no rule matches"
+	}
+	return false, strings.Join(reasons, "; ")
+}
+
+func pathMatch(pattern, p string) bool {
+	if strings.HasSuffix(pattern, "/**") {
+		prefix := strings.TrimSuffix(pattern, "**")
+		return p+"/" == prefix || strings.HasPrefix(p, prefix)
+	}
+	ok, err := path.Match(pattern, p)
+	return err == nil && ok
+}
+
+type RBACFilter struct{}
+
+func (f *RBACFilter) GetType() string {
+	return "PRE"
+}
+
+func (f *RBACFilter) GetOrder() int {
+	return 1
+}
+
+func (f *RBACFilter) ShouldFilter(r *http.Request) (bool, error) {
+	return true, nil
+}
+
+func (f *RBACFilter) Run(r *http.Request) error {
+	route := RequestRoute(r)
+	if route == nil {
+		return &Abort{StatusCode: http.StatusForbidden, Message: "no route"}
+	}
+
+	policy := route.Authorization
+	if policy == nil {
+		policy = &RBACPolicy{}
+	}
+
+	method, reqPath := RequestMethodAndPath(r)
+	id := RequestIdentity(r)
+	subject := "anonymous"
+	if id != nil {
+		subject = id.Source + ":" + id.Subject
+	}
+
+	allowed, reason := policy.Decide(method, reqPath, id)
+	if allowed {
+		return nil
+	}
+
+	if policy.DryRun {
+		log.Printf("rbac: would deny %s %s for %s: %s", method, reqPath, subject, reason)
+		return nil
+	}
+
+	log.Printf("rbac: deny %s %s for %s: %s", method, reqPath, subject, reason)
+	if id == nil {
+		return &Abort{StatusCode: http.StatusUnauthorized, Message: "authentication required"}
+	}
+	return &Abort{StatusCode: http.StatusForbidden, Message: "forbidden"}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRBACPolicyDecide(t *testing.T) {
+	policy := &RBACPolicy{
+		Rules: []RBACRule{
+			{Methods: []string{"GET"}, Path: "/svc1/public/**"},
+			{Path: "/svc1/admin/*", Roles: []string{"admin"}},
+			{Methods: []string{"POST"}, Path: "/svc1/orders", Scopes: []string{"orders:write"}, Claims: map[string]string{"tenant": "acme"}},
+		},
+	}
+
+	admin := &Identity{Roles: []string{"admin"}}
+	writer := &Identity{Scopes: []string{"orders:write"}, Claims: map[string]interface{}{"tenant": "acme"}}
+	otherTenant := &Identity{Scopes: []string{"orders:write"}, Claims: map[string]interface{}{"tenant": "other"}}
+
+	cases := []struct {
+		method string
+		path   string
+		id     *Identity
+		want   bool
+	}{
+		{"GET", "/svc1/public/a/b", nil, true},
+		{"POST", "/svc1/public/a", nil, false},
+		{"GET", "/svc1/admin/users", nil, false},
+		{"GET", "/svc1/admin/users", writer, false},
+		{"DELETE", "/svc1/admin/users", admin, true},
+		{"POST", "/svc1/orders", writer, true},
+		{"POST", "/svc1/orders", otherTenant, false},
+		{"GET", "/svc2/anything", admin, false},
+	}
+
+	for _, c := range cases {
+		got, reason := policy.Decide(c.method, c.path, c.id)
+		if got != c.want {
+			t.Errorf("%s %s: got %v (%s), want %v", c.method, c.path, got, reason, c.want)
+		}
+	}
+}
+
+func TestRBACFilterPathTraversal(t *testing.T) {
+	route := &RouteSpec{Authorization: &RBACPolicy{Rules: []RBACRule{
+		{Methods: []string{"GET"}, Path: "/svc1/public/**"},
+		{Path: "/svc1/admin/*", Roles: []string{"admin"}},
+	}}}
+
+	cases := []struct {
+		target string
+		path   string
+		want   int
+	}{
+		{"/svc1/public/a", "/svc1/public/a", 0},
+		{"/svc1/public/a/", "/svc1/public/a/", 0},
+		{"/svc1/public/./a", "/svc1/public/a", 0},
+		{"/svc1/public/../admin/users", "/svc1/admin/users", http.StatusUnauthorized},
+		{"/svc1/public/a/../../admin/users", "/svc1/admin/users", http.StatusUnauthorized},
+		{"/svc1/public%2F..%2Fadmin/users", "/svc1/admin/users", http.StatusUnauthorized},
+		{"/svc1/public%2F..%2F..%2Fsvc2/users", "/svc2/users", http.StatusUnauthorized},
+		{"/svc1//admin/users", "/svc1/admin/users", http.StatusUnauthorized},
+		{"//svc1/public//a", "/svc1/public/a", 0},
+	}
+	for _, c := range cases {
+		var got int
+		withRequestContext(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, p := RequestMethodAndPath(r); p != c.path {
+				t.Errorf("%s: expected the path %s, got %s", c.target, c.path, p)
+			}
+			getRequestContext(r).route = route
+			if err := (&RBACFilter{}).Run(r); err != nil {
+				got = toAbort(err).StatusCode
+			}
+		})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", c.target, nil))
+		if got != c.want {
+			t.Errorf("%s: got status %d, want %d", c.target, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type RedisRateLimitConfig struct {
+	Addr     string `json:"addr"`
+	Password string `json:"password"`
+	DB       int    `json:"db"`
+	// KeyPrefix defaults to "mini-gateway:ratelimit:".
+	KeyPrefix string `json:"key_prefix"`
+	// Timeout bounds every round trip to redis, defaults to 50ms.
+	Timeout Duration `json:"timeout"`
+
+	// BatchSize is how many tokens an instance takes per round trip and hands out
+	// locally, defaults to 1. Bigger batches save round trips but let a busy
+	// instance hold tokens other instances could have used.
+	BatchSize int `json:"batch_size"`
+	// BatchTTL is how long unused tokens of a batch stay valid, defaults to 1s.
+	BatchTTL Duration `json:"batch_ttl"`
+
+	// FailOpen allows requests when redis can not be reached, otherwise they are
+	// rejected.
+	FailOpen bool `json:"fail_open"`
+}
+
+// tokenBucketScript takes up to ARGV[4] tokens from the bucket in KEYS[1] which
+// refills ARGV[1] tokens per second up to ARGV[2]. ARGV[3] is now in milliseconds.
+// It returns the tokens taken and the tokens left.
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+if now > ts then
+	tokens = math.min(burst, tokens + (now - ts) * rate / 1000)
+	ts = now
+end
+
+local taken = math.floor(math.min(n, tokens))
+if taken < 0 then
+	taken = 0
+end
+tokens = tokens - taken
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(ts))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {taken, tostring(tokens)}
+`)
+
+// slidingWindowScript counts requests in fixed windows, KEYS[1] the current one and
+// KEYS[2] the previous one, and weighs the previous window by how much of it still
+// overlaps the sliding window. ARGV are the limit, the window and the time elapsed
+// in the current window, both in milliseconds, and the requests to take. It returns
+// the requests taken and the counts of both windows.
+var slidingWindowScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local elapsed = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+
+local cur = tonumber(redis.call('GET', KEYS[1]) or '0')
+local prev = tonumber(redis.call('GET', KEYS[2]) or '0')
+local count = prev * (window - elapsed) / window + cur
+
+local taken = math.floor(math.min(n, limit - count))
+if taken < 0 then
+	taken = 0
+end
+if taken > 0 then
+	cur = redis.call('INCRBY', KEYS[1], taken)
+	redis.call('PEXPIRE', KEYS[1], window * 2)
+end
+return {taken, cur, prev}
+`)
+
+// redisRateLimitStore keeps the limiters in redis so that all gateway instances
+// share them.
+type redisRateLimitStore struct {
+	client    *redis.Client
+	prefix    string
+	timeout   time.Duration
+	batchSize int
+	batchTTL  time.Duration
+
+	// batches holds the tokens taken from redis but not handed out yet.
+	batches *lruCache
+}
+
+type rateLimitBatch struct {
+	mu      sync.Mutex
+	tokens  int
+	expires time.Time
+	// last is the result of the round trip which took the batch.
+	last RateLimitResult
+}
+
+func newRedisRateLimitStore(cfg *RedisRateLimitConfig) *redisRateLimitStore {
+	s := &redisRateLimitStore{
+		client: redis.NewClient(&redis.Options{
+			Addr:     cfg.Addr,
+			Password: cfg.Password,
+			DB:       cfg.DB,
+		}),
+		prefix:    cfg.KeyPrefix,
+		timeout:   time.Duration(cfg.Timeout),
+		batchSize: cfg.BatchSize,
+		batchTTL:  time.Duration(cfg.BatchTTL),
+		batches:   newLRUCache(defaultRateLimitMaxKeys),
+	}
+
+	if s.prefix == "" {
+		s.prefix = "mini-gateway:ratelimit:"
+	}
+	if s.timeout <= 0 {
+		s.timeout = 50 * time.Millisecond
+	}
+	if s.batchSize <= 0 {
+		s.batchSize = 1
+	}
+	if s.batchTTL <= 0 {
+		s.batchTTL = time.Second
+	}
+
+	return s
+}
+
+func (s *redisRateLimitStore) Take(rule *RateLimitRule, key string) (*RateLimitResult, error) {
+	batch := s.batches.getOrAdd(key, func() interface{} {
+		return &rateLimitBatch{}
+	}).(*rateLimitBatch)
+
+	batch.mu.Lock()
+	defer batch.mu.Unlock()
+
+	now := time.Now()
+	if batch.tokens > 0 && now.Before(batch.expires) {
+		batch.tokens--
+		res := batch.last
+		res.Remaining += batch.tokens
+		return &res, nil
+	}
+
+	taken, res, err := s.take(rule, key, s.batchSize, now)
+	if err != nil {
+		return nil, err
+	}
+	if taken == 0 {
+		batch.tokens = 0
+		return res, nil
+	}
+
+	batch.tokens = taken - 1
+	batch.expires = now.Add(s.batchTTL)
+	batch.last = *res
+
+	res.Remaining += batch.tokens
+	return res, nil
+}
+
+// take takes up to n tokens from redis. The result does not count the tokens taken
+// beyond the first one.
+func (s *redisRateLimitStore) take(rule *RateLimitRule, key string, n int, now time.Time) (int, *RateLimitResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	if rule.Algorithm == "sliding_window" {
+		return s.takeSlidingWindow(ctx, rule, key, n, now)
+	}
+	return s.takeTokenBucket(ctx, rule, key, n, now)
+}
+
+func (s *redisRateLimitStore) takeTokenBucket(ctx context.Context, rule *RateLimitRule, key string, n int, now time.Time) (int, *RateLimitResult, error) {
+	reply, err := tokenBucketScript.Run(ctx, s.client, []string{s.prefix + key},
+		rule.Rate, rule.Burst, now.UnixNano()/int64(time.Millisecond), n).Slice()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(reply) != 2 {
+		return 0, nil, fmt.Errorf("unexpected token bucket reply %v", reply)
+	}
+
+	taken, _ := reply[0].(int64)
+	tokens, err := strconv.ParseFloat(fmt.Sprint(reply[1]), 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("unexpected token bucket reply %v", reply)
+	}
+
+	res := &RateLimitResult{
+		Allowed:   taken > 0,
+		Limit:     rule.Burst,
+		Remaining: int(tokens),
+	}
+	if rule.Rate > 0 {
+		res.Reset = time.Duration((float64(rule.Burst) - tokens) / rule.Rate * float64(time.Second))
+		if taken == 0 {
+			res.RetryAfter = time.Duration((1 - tokens) / rule.Rate * float64(time.Second))
+		}
+	}
+
+	return int(taken), res, nil
+}
+
+func (s *redisRateLimitStore) takeSlidingWindow(ctx context.Context, rule *RateLimitRule, key string, n int, now time.Time) (int, *RateLimitResult, error) {
+	window := time.Duration(float64(rule.Burst) / rule.Rate * float64(time.Second))
+	if window < time.Millisecond {
+		window = time.Millisecond
+	}
+	windowMs := int64(window / time.Millisecond)
+	nowMs := now.UnixNano() / int64(time.Millisecond)
+	index := nowMs / windowMs
+	elapsedMs := nowMs % windowMs
+
+	keys := []string{
+		s.prefix + key + ":" + strconv.FormatInt(index, 10),
+		s.prefix + key + ":" + strconv.FormatInt(index-1, 10),
+	}
+	reply, err := slidingWindowScript.Run(ctx, s.client, keys, rule.Burst, windowMs, elapsedMs, n).Int64Slice()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(reply) != 3 {
+		return 0, nil, fmt.Errorf("unexpected sliding window reply %v", reply)
+	}
+
+	taken, cur, prev := reply[0], float64(reply[1]), float64(reply[2])
+	limit := float64(rule.Burst)
+	w, e := float64(windowMs), float64(elapsedMs)
+	count := prev*(w-e)/w + cur
+
+	res := &RateLimitResult{
+		Allowed: taken > 0,
+		Limit:   rule.Burst,
+		Reset:   time.Duration(windowMs-elapsedMs) * time.Millisecond,
+	}
+	if count < limit {
+		res.Remaining = int(limit - count)
+	}
+
+	if taken == 0 {
+		// when will prev*(w-t)/w + cur + 1 <= limit hold again
+		var wait float64
+		if prev > 0 && cur+1 <= limit {
+			wait = w*(1-(limit-1-cur)/prev) - e
+		} else {
+			wait = w - e + math.Max(0, w*(1-(limit-1)/cur))
+		}
+		res.RetryAfter = time.Duration(wait) * time.Millisecond
+	}
+
+	return int(taken), res, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestRedisStore(t *testing.T, cfg RedisRateLimitConfig) (*miniredis.Miniredis, *redisRateLimitStore) {
+	mr := miniredis.RunT(t)
+	cfg.Addr = mr.Addr()
+	return mr, newRedisRateLimitStore(&cfg)
+}
+
+func TestRedisTokenBucket(t *testing.T) {
+	_, store := newTestRedisStore(t, RedisRateLimitConfig{})
+	rule := &RateLimitRule{Rate: 1, Burst: 3}
+
+	for i := 0; i < 3; i++ {
+		res, err := store.Take(rule, "k")
+		if err != nil || !res.Allowed || res.Remaining != 2-i {
+			t.Fatalf("request %d: %+v %v", i, res, err)
+		}
+	}
+
+	res, err := store.Take(rule, "k")
+	if err != nil || res.Allowed || res.RetryAfter <= 0 {
+		t.Fatalf("over the limit: %+v %v", res, err)
+	}
+
+	if res, _ := store.Take(rule, "other"); !res.Allowed {
+		t.Error("keys share a bucket")
+	}
+}
+
+func TestRedisSlidingWindow(t *testing.T) {
+	_, store := newTestRedisStore(t, RedisRateLimitConfig{})
+	rule := &RateLimitRule{Rate: 5, Burst: 5, Algorithm: "sliding_window"}
+
+	allowed := 0
+	for i := 0; i < 8; i++ {
+		res, err := store.Take(rule, "k")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Allowed {
+			allowed++
+		} else if res.RetryAfter <= 0 || res.RetryAfter > 2*time.Second {
+			t.Errorf("retry after %v", res.RetryAfter)
+		}
+	}
+	if allowed != 5 {
+		t.Errorf("allowed %d requests, want 5", allowed)
+	}
+}
+
+func TestRedisBatching(t *testing.T) {
+	run := func(batchSize int) (int, int) {
+		mr, store := newTestRedisStore(t, RedisRateLimitConfig{BatchSize: batchSize})
+		rule := &RateLimitRule{Rate: 1, Burst: 25}
+
+		allowed := 0
+		for i := 0; i < 30; i++ {
+			res, err := store.Take(rule, "k")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Allowed {
+				allowed++
+			}
+		}
+		return allowed, mr.CommandCount()
+	}
+
+	allowed, single := run(1)
+	if allowed != 25 {
+		t.Errorf("allowed %d requests without batching, want 25", allowed)
+	}
+
+	allowed, batched := run(10)
+	if allowed != 25 {
+		t.Errorf("allowed %d requests with batching, want 25", allowed)
+	}
+	if batched*3 > single {
+		t.Errorf("%d redis commands with batching, %d without", batched, single)
+	}
+}
+
+func TestRedisFailOpen(t *testing.T) {
+	mr, store := newTestRedisStore(t, RedisRateLimitConfig{})
+	mr.Close()
+
+	rules := []RateLimitRule{{Descriptors: []RateLimitDescriptor{{Key: "method"}}, Rate: 1, Burst: 1}}
+	r := httptest.NewRequest("GET", "/", nil)
+
+	if res := NewRateLimiter("global", rules, store, true).Take(r); res != nil && !res.Allowed {
+		t.Errorf("fail open denied: %+v", res)
+	}
+	if res := NewRateLimiter("global", rules, store, false).Take(r); res == nil || res.Allowed {
+		t.Errorf("fail closed allowed: %+v", res)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/google/uuid"
+	"net/http"
+)
+
+const (
+	requestIDHeader    = "X-Request-Id"
+	maxRequestIDLength = 128
+)
+
+// validRequestID accepts the usual ID formats, uuids, hex and base64 strings, and
+// rejects anything which could break logs or headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':' || c == '+' || c == '/' || c == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDHandler keeps a valid X-Request-Id of the client or replaces it with a
+// new one. The ID goes upstream in the request header, back to the client in the
+// response header, and into access logs and error bodies.
+//
+// It is a handler rather than a route filter so that requests rejected before
+// routing get an ID too. It goes inside withRequestContext.
+type requestIDHandler struct {
+	next http.Handler
+}
+
+func NewRequestIDHandler(next http.Handler) http.Handler {
+	return &requestIDHandler{next: next}
+}
+
+func (h *requestIDHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(requestIDHeader)
+	if !validRequestID(id) {
+		id = uuid.New().String()
+	}
+
+	getRequestContext(r).requestID = id
+	r.Header.Set(requestIDHeader, id)
+	w.Header().Set(requestIDHeader, id)
+
+	h.next.ServeHTTP(w, r)
+}
+
+// RequestID returns the ID of the request, empty if it did not go through
+// requestIDHandler.
+func RequestID(r *http.Request) string {
+	return getRequestContext(r).requestID
+}
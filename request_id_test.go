@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDHandler(t *testing.T) {
+	var abortBody map[string]interface{}
+	h := withRequestContext(NewRequestIDHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp := (&Abort{StatusCode: http.StatusForbidden, Message: "denied"}).response(r)
+		json.NewDecoder(resp.Body).Decode(&abortBody)
+	})))
+
+	cases := []struct {
+		incoming string
+		kept     bool
+	}{
+		{"3f2a9c1e-7b4d-4e8a-9f00-1234567890ab", true},
+		{"abc.DEF_123:x+y/z=", true},
+		{"", false},
+		{"bad id\r\nX-Injected: 1", false},
+		{strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		if c.incoming != "" {
+			r.Header[requestIDHeader] = []string{c.incoming}
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+
+		id := rec.Header().Get(requestIDHeader)
+		if c.kept && id != c.incoming {
+			t.Errorf("%q: expected the incoming id to be kept, got %q", c.incoming, id)
+		}
+		if !c.kept && (id == c.incoming || !validRequestID(id)) {
+			t.Errorf("%q: expected a new id, got %q", c.incoming, id)
+		}
+		if abortBody["request_id"] != id {
+			t.Errorf("%q: expected the error body to carry %q, got %v", c.incoming, id, abortBody)
+		}
+	}
+}
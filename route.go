@@ -1,5 +1,12 @@
 package main
 
+import (
+	"fmt"
+	"github.com/fullstorydev/grpcurl"
+	"regexp"
+	"sync/atomic"
+)
+
 var registeredRoutes = []RouteSpec{
 	{
 		Path: "^/svc1/(.*)",
@@ -25,13 +32,153 @@ var registeredRoutes = []RouteSpec{
 }
 
 type Upstream struct {
-	Host         string
-	Schema       string
-	GrpcEndPoint string
+	Host         string `json:"host"`
+	Schema       string `json:"schema"`
+	GrpcEndPoint string `json:"grpc_endpoint"`
+
+	// Concurrency limits the requests in flight to this host, shared by all routes
+	// using it. The routes configuring the host must give it the same limit.
+	Concurrency *ConcurrencyConfig `json:"concurrency"`
+
+	// Protosets are compiled descriptor sets and ProtoFiles .proto sources found in
+	// ImportPaths. Grpc upstreams with either are called without server reflection.
+	Protosets   []string `json:"protosets"`
+	ProtoFiles  []string `json:"proto_files"`
+	ImportPaths []string `json:"import_paths"`
+
+	// Transcode calls the methods bound to the request's method and path with
+	// google.api.http annotations, instead of GrpcEndPoint.
+	Transcode bool `json:"transcode"`
+
+	// descriptors are loaded from Protosets or ProtoFiles by newRouteTable, with
+	// their transcoder if Transcode is set.
+	descriptors grpcurl.DescriptorSource
+	transcoder  *transcoder
 }
 
 type RouteSpec struct {
-	Path      string
-	Upstreams []Upstream
-	Filters   []string
+	// Name identifies the route in rate limits, logs and metrics, it defaults to Path.
+	Name      string     `json:"name"`
+	Path      string     `json:"path"`
+	Upstreams []Upstream `json:"upstreams"`
+	Filters   []string   `json:"filters"`
+
+	// AllowedClients are identity patterns checked by the mtls filter, see Identity.Matches.
+	AllowedClients []string `json:"allowed_clients"`
+
+	// Authorization is checked by the rbac filter.
+	Authorization *RBACPolicy `json:"authorization"`
+
+	// Policy is the name of the policy checked by the policy filter.
+	Policy string `json:"policy"`
+
+	// CORS is applied by the cors filter.
+	CORS *CORSPolicy `json:"cors"`
+
+	// IPAccess is checked by the ip_access filter.
+	IPAccess *IPAccessPolicy `json:"ip_access"`
+
+	// RateLimits apply after the PRE filters, on top of the global rate limits.
+	RateLimits []RateLimitRule `json:"rate_limits"`
+
+	// Concurrency limits the requests of the route in flight to the upstreams.
+	Concurrency *ConcurrencyConfig `json:"concurrency"`
+
+	// AccessLogSampleRate is the share of requests logged, between 0 and 1. Defaults
+	// to logging all of them, server errors are always logged.
+	AccessLogSampleRate *float64 `json:"access_log_sample_rate"`
+}
+
+func (r *RouteSpec) ID() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.Path
+}
+
+// routeTable is the routes the gateway serves, in match order, with their compiled
+// paths. A published table is never changed, the admin API swaps in a new one.
+// Routes which did not change keep their pointer, so the state kept per route, like
+// rate limiters, survives the swap.
+type routeTable struct {
+	routes  []*RouteSpec
+	regexps []*regexp.Regexp
+}
+
+var currentRoutes atomic.Value // *routeTable
+
+func newRouteTable(routes []*RouteSpec) (*routeTable, error) {
+	t := &routeTable{
+		routes:  routes,
+		regexps: make([]*regexp.Regexp, len(routes)),
+	}
+	for i, route := range routes {
+		reg, err := regexp.Compile(route.Path)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: invalid path: %v", route.ID(), err)
+		}
+		t.regexps[i] = reg
+
+		for j := range route.Upstreams {
+			if err := route.Upstreams[j].loadDescriptors(); err != nil {
+				return nil, fmt.Errorf("route %s: %v", route.ID(), err)
+			}
+		}
+	}
+	return t, nil
+}
+
+// setRoutes makes routes the live routes.
+func setRoutes(routes []RouteSpec) error {
+	ptrs := make([]*RouteSpec, len(routes))
+	for i := range routes {
+		route := routes[i]
+		ptrs[i] = &route
+	}
+	t, err := newRouteTable(ptrs)
+	if err != nil {
+		return err
+	}
+	currentRoutes.Store(t)
+	return nil
+}
+
+// loadRoutes returns the live routes, registeredRoutes until setRoutes is called.
+func loadRoutes() *routeTable {
+	if t, ok := currentRoutes.Load().(*routeTable); ok {
+		return t
+	}
+
+	var routes []*RouteSpec
+	for i := range registeredRoutes {
+		if _, err := regexp.Compile(registeredRoutes[i].Path); err != nil {
+			fmt.Println("invalid config item, ignore")
+			continue
+		}
+		routes = append(routes, &registeredRoutes[i])
+	}
+	t, _ := newRouteTable(routes)
+	currentRoutes.CompareAndSwap(nil, t)
+	return currentRoutes.Load().(*routeTable)
+}
+
+// find returns the route named name, nil if there is none.
+func (t *routeTable) find(name string) *RouteSpec {
+	for _, route := range t.routes {
+		if route.Name == name {
+			return route
+		}
+	}
+	return nil
+}
+
+// matchRoute returns the first route whose Path matches path, with the compiled Path.
+func matchRoute(path string) (*RouteSpec, *regexp.Regexp) {
+	t := loadRoutes()
+	for i, route := range t.routes {
+		if t.regexps[i].MatchString(path) {
+			return route, t.regexps[i]
+		}
+	}
+	return nil, nil
 }
@@ -2,15 +2,17 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
-	"regexp"
 	"sort"
 	"strings"
 	"sync"
@@ -20,6 +22,7 @@ import (
 
 const (
 	ServerFdOffset = 3
+	AdminFdOffset  = 4
 )
 
 type Server struct {
@@ -28,14 +31,25 @@ type Server struct {
 
 	httpTransport http.RoundTripper
 	grpcTransport GrpcTransport
+	globalLimiter *RateLimiter
+	routeLimiters *routeRateLimiters
+	concurrency   *concurrencyLimiters
+	health        *upstreamHealth
+	draining      bool
 
 	*http.Server
-	port         int
-	listener     net.Listener
-	handler      http.Handler
-	isChild      bool
-	sigChan      chan os.Signal
-	shutdownChan chan struct{}
+	port          int
+	tlsConfig     *tls.Config
+	proxyProtocol bool
+	listener      net.Listener
+	handler       http.Handler
+	isChild       bool
+	sigChan       chan os.Signal
+	shutdownChan  chan struct{}
+
+	adminAddr     string
+	adminHandler  http.Handler
+	adminListener net.Listener
 }
 
 func (s *Server) StartServe() error {
@@ -54,6 +68,17 @@ func (s *Server) StartServe() error {
 		WriteTimeout: 60 * time.Second, // TODO configuable
 	}
 
+	if s.adminAddr != "" {
+		s.adminListener, err = s.getAdminListener()
+		if err != nil {
+			return err
+		}
+		go func() {
+			err := http.Serve(s.adminListener, s.adminHandler)
+			log.Println("admin server stopped:", err)
+		}()
+	}
+
 	s.sigChan = make(chan os.Signal)
 	go s.handleSignals()
 
@@ -63,7 +88,19 @@ func (s *Server) StartServe() error {
 		syscall.Kill(syscall.Getppid(), syscall.SIGTERM)
 	}
 
-	err = s.Server.Serve(s.listener)
+	// s.listener stays a plain TCP listener so that fork can still hand its fd to
+	// the child, the wrapping happens here.
+	l := s.listener
+	if s.proxyProtocol {
+		l = clientIPResolver.ProxyProtocolListener(l)
+	}
+
+	if s.tlsConfig != nil {
+		s.Server.TLSConfig = s.tlsConfig
+		err = s.Server.ServeTLS(l, "", "")
+	} else {
+		err = s.Server.Serve(l)
+	}
 	if err != http.ErrServerClosed {
 		fmt.Println(err)
 		return err
@@ -82,6 +119,7 @@ func (s *Server) handleSignals() {
 		s.sigChan,
 		syscall.SIGHUP,
 		syscall.SIGINT,
+		syscall.SIGTERM,
 	)
 
 	pid := syscall.Getpid()
@@ -90,18 +128,58 @@ func (s *Server) handleSignals() {
 		switch sig {
 		case syscall.SIGHUP:
 			log.Println(pid, "Received SIGHUP. forking.")
-			err := s.fork()
-			if err != nil {
+			if err := s.reload(); err != nil {
 				log.Println("Fork err:", err)
 			}
-		case syscall.SIGINT:
-			log.Println(pid, "Received SIGINT.")
+		case syscall.SIGINT, syscall.SIGTERM:
+			// a child we forked sends SIGTERM once it serves.
+			log.Println(pid, "Received", sig)
 			s.shutdown()
 			fmt.Println("after shutdown")
 		}
 	}
 }
 
+// reload forks a child which loads the config again and takes over the listeners.
+func (s *Server) reload() error {
+	// the requests still answered here may go to redeployed upstreams too
+	s.refreshGrpcDescriptors()
+
+	err := s.fork()
+	if err != nil {
+		configReloads.WithLabelValues("failure").Inc()
+	} else {
+		configReloads.WithLabelValues("success").Inc()
+	}
+	return err
+}
+
+// refreshGrpcDescriptors makes the next call to each grpc upstream reflect again.
+func (s *Server) refreshGrpcDescriptors() {
+	if r, ok := s.grpcTransport.(interface{ RefreshDescriptors() }); ok {
+		r.RefreshDescriptors()
+	}
+}
+
+// SetDraining tells load balancers to stop sending requests, through the admin
+// /ready endpoint, and closes client connections once their current request is
+// answered. Requests are still served.
+func (s *Server) SetDraining(draining bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.draining = draining
+	if s.Server != nil {
+		s.Server.SetKeepAlivesEnabled(!draining)
+	}
+}
+
+func (s *Server) Draining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
 func (s *Server) fork() (err error) {
 	file, err := s.listener.(*net.TCPListener).File()
 	if err != nil {
@@ -124,6 +202,13 @@ func (s *Server) fork() (err error) {
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.ExtraFiles = []*os.File{file}
+	if s.adminListener != nil {
+		adminFile, err := s.adminListener.(*net.TCPListener).File()
+		if err != nil {
+			return err
+		}
+		cmd.ExtraFiles = append(cmd.ExtraFiles, adminFile)
+	}
 	cmd.Env = env
 
 	err = cmd.Start()
@@ -152,48 +237,85 @@ func (s *Server) getListener() (net.Listener, error) {
 	}
 }
 
+// getAdminListener takes over the admin listener of the parent, if it had one.
+func (s *Server) getAdminListener() (net.Listener, error) {
+	if s.isChild {
+		if l, err := net.FileListener(os.NewFile(AdminFdOffset, "")); err == nil {
+			return l, nil
+		}
+	}
+
+	l, err := net.Listen("tcp", s.adminAddr)
+	if err != nil {
+		return nil, fmt.Errorf("can not initialize admin listener: %+v", err)
+	}
+	return l, nil
+}
+
 func (s *Server) shutdown() {
 	fmt.Println("pre shutdown")
+	if s.adminListener != nil {
+		s.adminListener.Close()
+	}
 	err := s.Server.Shutdown(context.Background())
 	fmt.Println("post shutdown")
 	if err != nil {
 		fmt.Println(err)
 	}
+	// in-flight requests are done, the grpc connections can go
+	if c, ok := s.grpcTransport.(io.Closer); ok {
+		c.Close()
+	}
 	close(s.shutdownChan)
 }
 
 func (s *Server) Director(r *http.Request) {
-	for _, route := range registeredRoutes {
-		reg, err := regexp.Compile(route.Path)
-		if err != nil {
-			fmt.Println("invalid config item, ignore")
-		}
-
-		matched := reg.MatchString(r.URL.Path)
-		if !matched {
-			continue
-		}
-
-		// random select one upstream
-		index := rand.Intn(len(route.Upstreams))
-		upstream := route.Upstreams[index]
-
-		r.URL.Host = upstream.Host
-		r.URL.Scheme = upstream.Schema
+	var upstream *Upstream
+	span := startRoutingSpan(r)
+	route, reg := matchRoute(r.URL.Path)
+	defer func() {
+		endRoutingSpan(span, route, upstream)
+	}()
+	if route == nil {
+		return
+	}
 
-		if upstream.Schema != "grpc" {
+	// random select one upstream
+	index := rand.Intn(len(route.Upstreams))
+	upstream = &route.Upstreams[index]
+
+	r.URL.Host = upstream.Host
+	r.URL.Scheme = upstream.Schema
+
+	switch {
+	case upstream.Schema != "grpc":
+		subMatches := reg.FindStringSubmatch(r.URL.Path)
+		r.URL.Path = "/" + subMatches[1]
+	case upstream.Transcode:
+		// the method and path select the grpc method, below the route's prefix if
+		// it captures the rest. The prefix is cut from the escaped path, an escaped
+		// slash in a variable is no separator.
+		if reg.NumSubexp() > 0 {
+			if m := reg.FindStringSubmatch(r.URL.EscapedPath()); m != nil {
+				if path, err := url.PathUnescape("/" + m[1]); err == nil {
+					r.URL.Path, r.URL.RawPath = path, "/"+m[1]
+					break
+				}
+			}
 			subMatches := reg.FindStringSubmatch(r.URL.Path)
 			r.URL.Path = "/" + subMatches[1]
-		} else {
-			r.Method = upstream.GrpcEndPoint
+			r.URL.RawPath = ""
 		}
+	default:
+		r.Method = upstream.GrpcEndPoint
+	}
 
-		r.Header.Set(filtersHeaderKey, strings.Join(route.Filters, ","))
-
-		setOriginHeader(r)
+	r.Header.Set(filtersHeaderKey, strings.Join(route.Filters, ","))
+	rc := getRequestContext(r)
+	rc.route = route
+	rc.upstream = upstream
 
-		break
-	}
+	setOriginHeader(r)
 }
 
 func (s *Server) RoundTrip(r *http.Request) (*http.Response, error) {
@@ -223,50 +345,174 @@ func (s *Server) RoundTrip(r *http.Request) (*http.Response, error) {
 
 	sort.Slice(preFilters, filterSorter)
 
+	var resp *http.Response
+	var upstreamError error
+
+	rc := getRequestContext(r)
+	filterStart := time.Now()
+
 	for _, f := range preFilters {
+		begin := time.Now()
+		span := startFilterSpan(r, f)
 		ok, err := f.ShouldFilter(r)
-		if err != nil {
-			fmt.Println(err)
-			// TODO handler gateway error
+		if err == nil && ok {
+			err = f.(PreFilter).Run(r)
 		}
-		if ok {
-			err := f.(PreFilter).Run(r)
-			if err != nil {
+		observeFilter(f, time.Since(begin))
+		endFilterSpan(span, err)
+		if err != nil {
+			if _, aborted := err.(*Abort); !aborted {
 				fmt.Println(err)
-				// TODO handler gateway error
 			}
+			resp = toAbort(err).response(r)
+			break
 		}
 	}
 
-	var resp *http.Response
-	var upstreamError error
+	rc.filterDuration += time.Since(filterStart)
+
+	if resp == nil && s.routeLimiters != nil {
+		if res := s.routeLimiters.Take(r); res != nil {
+			if res.Allowed {
+				for k, v := range res.Header() {
+					ResponseHeader(r)[k] = v
+				}
+			} else {
+				rateLimitRejections.WithLabelValues("route", routeLabel(rc.route)).Inc()
+				resp = (&Abort{
+					StatusCode: http.StatusTooManyRequests,
+					Message:    "rate limit exceeded",
+					Header:     res.Header(),
+				}).response(r)
+			}
+		}
+	}
 
-	if r.URL.Scheme == "grpc" {
-		resp, upstreamError = s.grpcTransport.RoundTrip(r)
-	} else {
-		resp, upstreamError = s.httpTransport.RoundTrip(r)
+	var release func(dropped bool)
+	if resp == nil && s.concurrency != nil {
+		var err error
+		release, err = s.concurrency.Acquire(r)
+		if err != nil {
+			concurrencyRejections.WithLabelValues(routeLabel(rc.route)).Inc()
+			resp = (&Abort{
+				StatusCode: http.StatusServiceUnavailable,
+				Message:    err.Error(),
+				Header:     http.Header{"Retry-After": []string{"1"}},
+			}).response(r)
+		}
+	}
+
+	if resp == nil {
+		upstreamStart := time.Now()
+		upstreamReq, span := startUpstreamSpan(r)
+		if r.URL.Scheme == "grpc" {
+			resp, upstreamError = s.grpcTransport.RoundTrip(upstreamReq)
+		} else {
+			resp, upstreamError = s.httpTransport.RoundTrip(upstreamReq)
+		}
+		endUpstreamSpan(span, resp, upstreamError)
+		if s.health != nil && (resp != nil || upstreamError != nil) {
+			s.health.record(r.URL.Host, resp, upstreamError)
+		}
+		rc.upstreamDuration += time.Since(upstreamStart)
+		upstreamDuration.WithLabelValues(routeLabel(rc.route), upstreamLabel(rc.upstream)).
+			Observe(time.Since(upstreamStart).Seconds())
+
+		switch {
+		case rc.timeout.hasExpired():
+			// the upstream was cut off, whatever it answered is incomplete
+			if resp != nil && resp.Body != nil {
+				resp.Body.Close()
+			}
+			resp, upstreamError = (&Abort{StatusCode: http.StatusGatewayTimeout, Message: rc.timeout.msg}).response(r), nil
+		case resp != nil && resp.StatusCode == http.StatusSwitchingProtocols:
+			// the upstream took the upgrade, the connection lasts as long as both ends want
+			rc.timeout.lift()
+		}
+	}
+
+	if release != nil {
+		// the slot is held until the body is sent, failures and overload answers of
+		// the upstream shrink adaptive limits. Streams and upgrades last as long as
+		// the client wants, their slot is given back once the upstream answered.
+		dropped := upstreamError != nil || (resp != nil &&
+			(resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout))
+		if dropped || resp == nil || resp.Body == nil || isStreamedResponse(resp) {
+			release(dropped)
+		} else {
+			resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: release}
+		}
 	}
 
 	sort.Slice(postFilters, filterSorter)
 
+	filterStart = time.Now()
+
 	for _, f := range postFilters {
+		begin := time.Now()
+		span := startFilterSpan(r, f)
 		ok, err := f.ShouldFilter(r)
 		if err != nil {
 			fmt.Println(err)
 			// TODO handler gateway error
 		}
 		if ok {
-			err := f.(PostFilter).Run(r, resp, upstreamError)
+			err = f.(PostFilter).Run(r, resp, upstreamError)
 			if err != nil {
 				fmt.Println(err)
 				// TODO handler gateway error
 			}
 		}
+		observeFilter(f, time.Since(begin))
+		endFilterSpan(span, err)
+	}
+
+	rc.filterDuration += time.Since(filterStart)
+
+	if resp != nil {
+		if resp.Header == nil {
+			resp.Header = make(http.Header)
+		}
+		// requestIDHandler already set it, the proxy would add the upstream's echo
+		if rc.requestID != "" {
+			resp.Header.Del(requestIDHeader)
+		}
+		for k, v := range rc.responseHeader {
+			if listHeaders[k] {
+				addHeaderValues(resp.Header, k, v)
+			} else {
+				resp.Header[k] = v
+			}
+		}
 	}
 
 	return resp, upstreamError
 }
 
+// listHeaders are the response headers whose values the gateway adds to the ones of
+// the upstream rather than replacing them: a cache keying on the upstream's Vary
+// still needs it with the gateway's.
+var listHeaders = map[string]bool{"Vary": true}
+
+// addHeaderValues adds the comma separated values to the ones of h[key] it lacks.
+func addHeaderValues(h http.Header, key string, values []string) {
+	have := make(map[string]bool)
+	for _, v := range h[key] {
+		for _, token := range strings.Split(v, ",") {
+			have[strings.ToLower(strings.TrimSpace(token))] = true
+		}
+	}
+	for _, v := range values {
+		for _, token := range strings.Split(v, ",") {
+			token = strings.TrimSpace(token)
+			if token != "" && !have[strings.ToLower(token)] {
+				h.Add(key, token)
+				have[strings.ToLower(token)] = true
+			}
+		}
+	}
+}
+
 func setOriginHeader(r *http.Request) {
 	// do nothing for non-GET requests
 	if strings.ToUpper(r.Method) != "GET" || r.URL == nil {
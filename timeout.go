@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// requestTimeout ends a request which takes too long, unless the transport lifts it
+// for a stream.
+type requestTimeout struct {
+	timer   *time.Timer
+	msg     string
+	expired int32
+}
+
+// lift lets the request last as long as the upstream sends.
+func (t *requestTimeout) lift() {
+	if t != nil {
+		t.timer.Stop()
+	}
+}
+
+func (t *requestTimeout) hasExpired() bool {
+	return t != nil && atomic.LoadInt32(&t.expired) == 1
+}
+
+// liftTimeout lifts the timeout of r, the transports call it once the upstream
+// started streaming the response.
+func liftTimeout(r *http.Request) {
+	getRequestContext(r).timeout.lift()
+}
+
+// NewTimeoutHandler cancels requests after dt, the transport answers them with 504
+// and msg. Unlike http.TimeoutHandler it neither buffers the response nor hides the
+// connection, so the streams and upgrades the transport lifts the timeout for can be
+// flushed and hijacked.
+func NewTimeoutHandler(next http.Handler, dt time.Duration, msg string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		t := &requestTimeout{msg: msg}
+		t.timer = time.AfterFunc(dt, func() {
+			atomic.StoreInt32(&t.expired, 1)
+			cancel()
+		})
+		defer t.timer.Stop()
+		getRequestContext(r).timeout = t
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeoutHandler(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+		w.Write([]byte("done"))
+	}))
+	defer upstream.Close()
+
+	defer currentRoutes.Store(loadRoutes())
+	setRoutes([]RouteSpec{{
+		Path:      "^/svc/(.*)",
+		Upstreams: []Upstream{{Host: strings.TrimPrefix(upstream.URL, "http://"), Schema: "http"}},
+	}})
+
+	server := &Server{httpTransport: http.DefaultTransport}
+	proxy := &httputil.ReverseProxy{Director: server.Director, Transport: server}
+	gateway := httptest.NewServer(withRequestContext(NewTimeoutHandler(proxy, 100*time.Millisecond, "gateway timeout")))
+	defer gateway.Close()
+
+	get := func(path string, header http.Header) (int, string) {
+		req, _ := http.NewRequest("GET", gateway.URL+path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	if code, body := get("/svc/fast", nil); code != http.StatusOK || body != "done" {
+		t.Errorf("expected the fast request to pass, got %d %s", code, body)
+	}
+
+	// asking for a stream or an upgrade does not lift the timeout, only the transport
+	// streaming the response does
+	for _, header := range []http.Header{
+		nil,
+		{"Accept": {"text/event-stream"}},
+		{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}, "Sec-Websocket-Version": {"13"}, "Sec-Websocket-Key": {"dGhlIHNhbXBsZSBub25jZQ=="}},
+	} {
+		start := time.Now()
+		code, body := get("/svc/slow", header)
+		if code != http.StatusGatewayTimeout || !strings.Contains(body, "gateway timeout") {
+			t.Errorf("%v: expected 504, got %d %s", header, code, body)
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Errorf("%v: expected the request to end at the timeout, took %v", header, time.Since(start))
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+type TLSConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+
+	// ClientCAFiles are PEM bundles used to verify client certificates.
+	ClientCAFiles []string `json:"client_ca_files"`
+
+	// ClientAuth is one of "none", "optional" or "require". It defaults to
+	// "require" when ClientCAFiles is set and "none" otherwise.
+	ClientAuth string `json:"client_auth"`
+}
+
+func (c *TLSConfig) Build() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("can not load server certificate: %v", err)
+	}
+
+	tc := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if len(c.ClientCAFiles) > 0 {
+		pool := x509.NewCertPool()
+		for _, f := range c.ClientCAFiles {
+			pem, err := ioutil.ReadFile(f)
+			if err != nil {
+				return nil, fmt.Errorf("can not read client ca %s: %v", f, err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate found in client ca %s", f)
+			}
+		}
+		tc.ClientCAs = pool
+	}
+
+	switch c.ClientAuth {
+	case "":
+		if tc.ClientCAs != nil {
+			tc.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	case "none":
+		tc.ClientAuth = tls.NoClientCert
+	case "optional":
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client_auth %q", c.ClientAuth)
+	}
+
+	if tc.ClientAuth != tls.NoClientCert && tc.ClientCAs == nil {
+		return nil, fmt.Errorf("client_auth %q needs client_ca_files", c.ClientAuth)
+	}
+
+	return tc, nil
+}
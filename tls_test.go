@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testCert issues a certificate for tmpl, self signed when parent is nil.
+func testCert(t *testing.T, tmpl *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// writePEM writes the certificate, and the key if given, to files in dir.
+func writePEM(t *testing.T, dir, name string, cert *x509.Certificate, key *ecdsa.PrivateKey) (certFile, keyFile string) {
+	certFile = filepath.Join(dir, name+".crt")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if key == nil {
+		return certFile, ""
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile = filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func testCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	return testCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+}
+
+func TestTLSConfigBuild(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := testCA(t)
+	server, serverKey := testCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "gateway"}, DNSNames: []string{"gateway"}}, ca, caKey)
+	certFile, keyFile := writePEM(t, dir, "server", server, serverKey)
+	caFile, _ := writePEM(t, dir, "ca", ca, nil)
+	emptyFile := filepath.Join(dir, "empty.pem")
+	ioutil.WriteFile(emptyFile, []byte("no pem here"), 0600)
+
+	cases := []struct {
+		clientAuth string
+		caFiles    []string
+		want       tls.ClientAuthType
+		fails      bool
+	}{
+		{"", nil, tls.NoClientCert, false},
+		{"", []string{caFile}, tls.RequireAndVerifyClientCert, false},
+		{"none", []string{caFile}, tls.NoClientCert, false},
+		{"optional", []string{caFile}, tls.VerifyClientCertIfGiven, false},
+		{"require", []string{caFile}, tls.RequireAndVerifyClientCert, false},
+		{"require", nil, 0, true},
+		{"optional", nil, 0, true},
+		{"sometimes", []string{caFile}, 0, true},
+		{"require", []string{filepath.Join(dir, "missing.pem")}, 0, true},
+		{"require", []string{emptyFile}, 0, true},
+	}
+	for _, c := range cases {
+		cfg := &TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFiles: c.caFiles, ClientAuth: c.clientAuth}
+		tc, err := cfg.Build()
+		if c.fails {
+			if err == nil {
+				t.Errorf("client_auth %q with %v: expected an error", c.clientAuth, c.caFiles)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("client_auth %q with %v: %v", c.clientAuth, c.caFiles, err)
+			continue
+		}
+		if tc.ClientAuth != c.want || (len(c.caFiles) > 0) != (tc.ClientCAs != nil) {
+			t.Errorf("client_auth %q with %v: got %v, want %v", c.clientAuth, c.caFiles, tc.ClientAuth, c.want)
+		}
+	}
+
+	if _, err := (&TLSConfig{CertFile: certFile, KeyFile: certFile}).Build(); err == nil {
+		t.Error("expected a bad key pair to fail")
+	}
+}
+
+// clientIdentity returns the identity of a client certificate with a SPIFFE ID and
+// DNS names, as verified by the TLS listener.
+func clientIdentity(t *testing.T) *Identity {
+	ca, caKey := testCA(t)
+	spiffe, _ := url.Parse("spiffe://example.org/ns/prod/sa/orders")
+	cert, _ := testCert(t, &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "orders", Organization: []string{"Example"}},
+		DNSNames: []string{"orders.prod.svc", "orders.internal"},
+		URIs:     []*url.URL{{Scheme: "https", Host: "example.org"}, spiffe},
+	}, ca, caKey)
+	return identityFromTLS(&tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert, ca}}})
+}
+
+func TestIdentityFromTLS(t *testing.T) {
+	defer func(grants []IdentityGrant) { registeredGrants = grants }(registeredGrants)
+	registeredGrants = []IdentityGrant{
+		{Match: "spiffe://example.org/ns/prod/*/*", Roles: []string{"service"}},
+		{Match: "dns:*.internal", Scopes: []string{"internal:read"}},
+		{Match: "cn:billing", Roles: []string{"billing"}},
+	}
+
+	id := clientIdentity(t)
+	if id == nil {
+		t.Fatal("expected an identity for a verified certificate")
+	}
+	if id.Source != "mtls" || id.CommonName != "orders" || id.SPIFFEID != "spiffe://example.org/ns/prod/sa/orders" ||
+		!reflect.DeepEqual(id.DNSNames, []string{"orders.prod.svc", "orders.internal"}) {
+		t.Errorf("unexpected identity %+v", id)
+	}
+	if !reflect.DeepEqual(id.Roles, []string{"service"}) || !reflect.DeepEqual(id.Scopes, []string{"internal:read"}) {
+		t.Errorf("expected the matching grants, got roles %v scopes %v", id.Roles, id.Scopes)
+	}
+	if v, _ := id.Claim("spiffe_id"); v != id.SPIFFEID {
+		t.Errorf("expected the spiffe_id claim, got %q", v)
+	}
+
+	if identityFromTLS(nil) != nil || identityFromTLS(&tls.ConnectionState{}) != nil {
+		t.Error("expected no identity without a verified chain")
+	}
+}
+
+func TestIdentityMatches(t *testing.T) {
+	id := &Identity{
+		CommonName: "orders",
+		SPIFFEID:   "spiffe://example.org/ns/prod/sa/orders",
+		DNSNames:   []string{"orders.prod.svc", "orders.internal"},
+	}
+	cases := []struct {
+		pattern string
+		want    bool
+	}{
+		{"spiffe://example.org/ns/prod/sa/orders", true},
+		{"spiffe://example.org/ns/*/sa/orders", true},
+		{"spiffe://example.org/ns/dev/sa/*", false},
+		{"spiffe://example.org/*", false},
+		{"cn:orders", true},
+		{"cn:ord*", true},
+		{"cn:billing", false},
+		{"dns:*.internal", true},
+		{"dns:orders.prod.svc", true},
+		{"dns:*.dev.svc", false},
+		{"orders", false},
+		{"cn:[", false},
+	}
+	for _, c := range cases {
+		if got := id.Matches(c.pattern); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.pattern, got, c.want)
+		}
+	}
+
+	if (&Identity{}).Matches("spiffe://*") || (&Identity{}).Matches("cn:*") {
+		t.Error("expected empty fields to match nothing")
+	}
+}
+
+func TestMTLSFilter(t *testing.T) {
+	f := &MTLSFilter{}
+	run := func(id *Identity, route *RouteSpec) error {
+		r := httptest.NewRequest("GET", "/orders", nil)
+		r = r.WithContext(context.WithValue(r.Context(), requestContextKey{}, &requestContext{identity: id, route: route}))
+		return f.Run(r)
+	}
+	status := func(err error) int {
+		if a, ok := err.(*Abort); ok {
+			return a.StatusCode
+		}
+		return 0
+	}
+
+	id := clientIdentity(t)
+	cases := []struct {
+		name  string
+		id    *Identity
+		route *RouteSpec
+		want  int
+	}{
+		{"no certificate", nil, &RouteSpec{}, http.StatusUnauthorized},
+		{"any client", id, &RouteSpec{}, 0},
+		{"no route", id, nil, 0},
+		{"allowed", id, &RouteSpec{AllowedClients: []string{"cn:billing", "spiffe://example.org/ns/prod/sa/*"}}, 0},
+		{"not allowed", id, &RouteSpec{AllowedClients: []string{"cn:billing", "dns:*.dev.svc"}}, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		if got := status(run(c.id, c.route)); got != c.want {
+			t.Errorf("%s: got status %d, want %d", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc/metadata"
+	"net/http"
+	"strconv"
+)
+
+type TracingConfig struct {
+	// ServiceName defaults to "mini-gateway".
+	ServiceName string `json:"service_name"`
+	// Propagators are "tracecontext", "baggage", "b3" (single header) and "b3multi".
+	// They are all extracted, and all injected. Defaults to tracecontext.
+	Propagators []string `json:"propagators"`
+	// SampleRatio is the share of traces started at the gateway which are recorded,
+	// defaults to 1. Requests follow the sampling decision of their parent.
+	SampleRatio *float64 `json:"sample_ratio"`
+
+	// OTLP exports the spans, without it they are recorded but dropped.
+	OTLP *OTLPConfig `json:"otlp"`
+}
+
+type OTLPConfig struct {
+	// Endpoint is the collector's host:port.
+	Endpoint string `json:"endpoint"`
+	// Protocol is "grpc", the default, or "http".
+	Protocol string            `json:"protocol"`
+	Insecure bool              `json:"insecure"`
+	Headers  map[string]string `json:"headers"`
+}
+
+// Without tracing config the gateway records nothing but still passes the trace
+// context of the client on to the upstreams.
+var (
+	tracerProvider  trace.TracerProvider          = noop.NewTracerProvider()
+	tracePropagator propagation.TextMapPropagator = propagation.TraceContext{}
+)
+
+func tracer() trace.Tracer {
+	return tracerProvider.Tracer("github.com/xumc/mini-gateway")
+}
+
+// InitTracing sets up the tracer provider and propagators. The returned func
+// flushes the spans not exported yet.
+func InitTracing(cfg *TracingConfig) (func(context.Context) error, error) {
+	propagator, err := newTracePropagator(cfg.Propagators)
+	if err != nil {
+		return nil, err
+	}
+
+	var processors []sdktrace.SpanProcessor
+	if cfg.OTLP != nil {
+		exporter, err := newOTLPExporter(cfg.OTLP)
+		if err != nil {
+			return nil, err
+		}
+		processors = append(processors, sdktrace.NewBatchSpanProcessor(exporter))
+	}
+
+	tp := newTracerProvider(cfg, processors...)
+	tracerProvider = tp
+	tracePropagator = propagator
+	return tp.Shutdown, nil
+}
+
+func newTracerProvider(cfg *TracingConfig, processors ...sdktrace.SpanProcessor) *sdktrace.TracerProvider {
+	name := cfg.ServiceName
+	if name == "" {
+		name = "mini-gateway"
+	}
+	ratio := 1.0
+	if cfg.SampleRatio != nil {
+		ratio = *cfg.SampleRatio
+	}
+
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", name))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	}
+	for _, p := range processors {
+		opts = append(opts, sdktrace.WithSpanProcessor(p))
+	}
+	return sdktrace.NewTracerProvider(opts...)
+}
+
+func newTracePropagator(names []string) (propagation.TextMapPropagator, error) {
+	if len(names) == 0 {
+		return propagation.TraceContext{}, nil
+	}
+
+	propagators := make([]propagation.TextMapPropagator, 0, len(names))
+	for _, name := range names {
+		switch name {
+		case "tracecontext":
+			propagators = append(propagators, propagation.TraceContext{})
+		case "baggage":
+			propagators = append(propagators, propagation.Baggage{})
+		case "b3":
+			propagators = append(propagators, b3.New())
+		case "b3multi":
+			propagators = append(propagators, b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader)))
+		default:
+			return nil, fmt.Errorf("unknown trace propagator %q", name)
+		}
+	}
+	return propagation.NewCompositeTextMapPropagator(propagators...), nil
+}
+
+func newOTLPExporter(cfg *OTLPConfig) (sdktrace.SpanExporter, error) {
+	ctx := context.Background()
+
+	switch cfg.Protocol {
+	case "", "grpc":
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint), otlptracegrpc.WithHeaders(cfg.Headers)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		return otlptracegrpc.New(ctx, opts...)
+	case "http":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint), otlptracehttp.WithHeaders(cfg.Headers)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, opts...)
+	}
+	return nil, fmt.Errorf("unknown otlp protocol %q", cfg.Protocol)
+}
+
+// injectTraceHeaders sets the trace context of ctx on the upstream request.
+func injectTraceHeaders(ctx context.Context, h http.Header) {
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(h))
+}
+
+// traceMetadata returns the trace context of ctx as gRPC metadata.
+func traceMetadata(ctx context.Context) metadata.MD {
+	carrier := propagation.MapCarrier{}
+	tracePropagator.Inject(ctx, carrier)
+	return metadata.New(carrier)
+}
+
+// tracingHandler starts the server span of a request, continuing the trace of the
+// client. It goes inside withRequestContext to name the span after the route.
+type tracingHandler struct {
+	next http.Handler
+}
+
+func NewTracingHandler(next http.Handler) http.Handler {
+	return &tracingHandler{next: next}
+}
+
+func (h *tracingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer().Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+		))
+	defer span.End()
+
+	rw := &statusRecorder{ResponseWriter: w}
+	h.next.ServeHTTP(rw, r.WithContext(ctx))
+
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+
+	rc := getRequestContext(r)
+	if rc.route != nil {
+		span.SetName(r.Method + " " + rc.route.ID())
+		span.SetAttributes(attribute.String("mini_gateway.route", rc.route.ID()))
+	}
+	if rc.clientIP != nil {
+		span.SetAttributes(attribute.String("client.address", rc.clientIP.String()))
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", rw.status))
+	if rw.status >= 500 {
+		span.SetStatus(codes.Error, strconv.Itoa(rw.status))
+	}
+}
+
+// endUpstreamSpan records the outcome of the upstream round trip.
+func endUpstreamSpan(span trace.Span, resp *http.Response, err error) {
+	switch {
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	case resp != nil:
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		if resp.StatusCode >= 500 {
+			span.SetStatus(codes.Error, strconv.Itoa(resp.StatusCode))
+		}
+	}
+	span.End()
+}
+
+func startRoutingSpan(r *http.Request) trace.Span {
+	_, span := tracer().Start(r.Context(), "routing")
+	return span
+}
+
+func endRoutingSpan(span trace.Span, route *RouteSpec, upstream *Upstream) {
+	if route != nil {
+		span.SetAttributes(attribute.String("mini_gateway.route", route.ID()))
+	}
+	if upstream != nil {
+		span.SetAttributes(attribute.String("mini_gateway.upstream", upstream.Host))
+	}
+	span.End()
+}
+
+func startFilterSpan(r *http.Request, f Filter) trace.Span {
+	_, span := tracer().Start(r.Context(), "filter "+filterName(f),
+		trace.WithAttributes(attribute.String("mini_gateway.filter.type", f.GetType())))
+	return span
+}
+
+// endFilterSpan records the outcome of a filter, an Abort is not an error of the
+// filter.
+func endFilterSpan(span trace.Span, err error) {
+	if abort, ok := err.(*Abort); ok {
+		span.SetAttributes(attribute.Int("mini_gateway.abort.status_code", abort.StatusCode))
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// startUpstreamSpan returns the request carrying the span and its trace headers.
+func startUpstreamSpan(r *http.Request) (*http.Request, trace.Span) {
+	ctx, span := tracer().Start(r.Context(), "upstream "+r.URL.Host,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("server.address", r.URL.Host),
+			attribute.String("url.scheme", r.URL.Scheme),
+		))
+	r = r.WithContext(ctx)
+	injectTraceHeaders(ctx, r.Header)
+	return r, span
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"testing"
+)
+
+func TestTracingPropagation(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	defer func(tp trace.TracerProvider, prop propagation.TextMapPropagator) {
+		tracerProvider, tracePropagator = tp, prop
+	}(tracerProvider, tracePropagator)
+	tracerProvider = newTracerProvider(&TracingConfig{}, sdktrace.NewSimpleSpanProcessor(exporter))
+	tracePropagator, _ = newTracePropagator([]string{"tracecontext", "b3"})
+
+	var upstreamHeader http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header
+	}))
+	defer upstream.Close()
+
+	defer currentRoutes.Store(loadRoutes())
+	routes := []RouteSpec{{
+		Name:      "traced",
+		Path:      "^/traced/(.*)",
+		Upstreams: []Upstream{{Host: strings.TrimPrefix(upstream.URL, "http://"), Schema: "http"}},
+	}}
+	setRoutes(routes)
+
+	server := &Server{httpTransport: http.DefaultTransport}
+	proxy := &httputil.ReverseProxy{Director: server.Director, Transport: server}
+	gateway := httptest.NewServer(withRequestContext(NewTracingHandler(proxy)))
+	defer gateway.Close()
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, _ := http.NewRequest("GET", gateway.URL+"/traced/hello", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	spans := exporter.GetSpans()
+	names := map[string]tracetest.SpanStub{}
+	for _, s := range spans {
+		if s.SpanContext.TraceID().String() != traceID {
+			t.Errorf("span %s is not part of the client's trace", s.Name)
+		}
+		names[s.Name] = s
+	}
+	for _, name := range []string{"GET traced", "routing", "upstream " + routes[0].Upstreams[0].Host} {
+		if _, ok := names[name]; !ok {
+			t.Errorf("missing span %q in %v", name, spans)
+		}
+	}
+
+	upstreamSpan := names["upstream "+routes[0].Upstreams[0].Host]
+	if !strings.Contains(upstreamHeader.Get("traceparent"), upstreamSpan.SpanContext.SpanID().String()) {
+		t.Errorf("upstream got traceparent %q, expected the upstream span %s", upstreamHeader.Get("traceparent"), upstreamSpan.SpanContext.SpanID())
+	}
+	if upstreamHeader.Get("b3") == "" {
+		t.Errorf("expected a b3 header upstream")
+	}
+}
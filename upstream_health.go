@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// unhealthyAfter is how many consecutive failures mark an upstream unhealthy.
+const unhealthyAfter = 5
+
+// upstreamHealth tracks the outcome of the requests to every upstream host. It is
+// passive, nothing probes the upstreams and no request is held back because of it.
+type upstreamHealth struct {
+	mu    sync.Mutex
+	hosts map[string]*UpstreamHealthState
+}
+
+// UpstreamHealthState counts transport errors and 502, 503 and 504 answers as
+// failures.
+type UpstreamHealthState struct {
+	Healthy             bool      `json:"healthy"`
+	Requests            int64     `json:"requests"`
+	Failures            int64     `json:"failures"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastError           string    `json:"last_error,omitempty"`
+	LastFailure         time.Time `json:"last_failure,omitempty"`
+	LastSuccess         time.Time `json:"last_success,omitempty"`
+}
+
+func newUpstreamHealth() *upstreamHealth {
+	return &upstreamHealth{hosts: make(map[string]*UpstreamHealthState)}
+}
+
+func (h *upstreamHealth) record(host string, resp *http.Response, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.hosts[host]
+	if !ok {
+		s = &UpstreamHealthState{}
+		h.hosts[host] = s
+	}
+
+	s.Requests++
+	now := time.Now()
+	switch {
+	case err != nil:
+		s.LastError = err.Error()
+	case resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable ||
+		resp.StatusCode == http.StatusGatewayTimeout:
+		s.LastError = resp.Status
+	default:
+		s.ConsecutiveFailures = 0
+		s.LastSuccess = now
+		s.Healthy = true
+		return
+	}
+
+	s.Failures++
+	s.ConsecutiveFailures++
+	s.LastFailure = now
+	s.Healthy = s.ConsecutiveFailures < unhealthyAfter
+}
+
+// State returns the state of host, an upstream without requests yet is healthy.
+func (h *upstreamHealth) State(host string) UpstreamHealthState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if s, ok := h.hosts[host]; ok {
+		return *s
+	}
+	return UpstreamHealthState{Healthy: true}
+}